@@ -7,6 +7,7 @@ import (
 	"encoding/base64"
 	"flag"
 	"fmt"
+	"io"
 	"net"
 	"os"
 	"os/signal"
@@ -22,6 +23,7 @@ import (
 	"github.com/cupen/xdisco/broker/k8s"
 	"github.com/cupen/xdisco/health"
 	"github.com/cupen/xdisco/logs"
+	"github.com/cupen/xdisco/pool"
 	"github.com/cupen/xdisco/server"
 	"go.uber.org/zap"
 )
@@ -65,47 +67,49 @@ func runClient(broker, username string) {
 
 	fmt.Printf("!hello '%s'!\n", username)
 
-	for {
-		s := svc.GetServerList().Lookup(username)
-		if s == nil {
-			fmt.Println("no server found")
-			return
+	p := pool.New(svc, func(s *server.Server) (io.Closer, error) {
+		conn, err := net.Dial("tcp", s.PrivateAddress("tcp"))
+		if err != nil {
+			return nil, err
 		}
-		addr := s.PrivateAddress("tcp")
-		conn, err := net.Dial("tcp", addr)
+		return NewPacketCodec(conn), nil
+	}, pool.DefaultOptions())
+	p.Start(context.TODO())
+
+	showPrompt := func() {
+		fmt.Printf("$ [%s]: ", username)
+	}
+	showPrompt()
+	scanner := bufio.NewScanner(os.Stdin)
+	for scanner.Scan() {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "quit" || text == "exit" {
+			break
+		}
+		conn, err := p.Get(username)
 		if err != nil {
-			panic(fmt.Errorf("dial failed: %w", err))
+			log2.Warnf("no connection: %v", err)
+			showPrompt()
+			continue
 		}
-		showPrompt := func() {
-			fmt.Printf("$ [%s]: ", addr)
+		c := conn.(*TcpCodec)
+		if err := c.Write([]byte(text)); err != nil {
+			log2.Warnf("write failed: %v", err)
+			p.Invalidate(c)
+			showPrompt()
+			continue
 		}
-
-		showPrompt()
-
-		scanner := bufio.NewScanner(os.Stdin)
-
-		c := NewPacketCodec(conn)
-		for scanner.Scan() {
-			text := strings.TrimSpace(scanner.Text())
-			if text == "quit" || text == "exit" {
-				defer c.Close()
-				break
-			}
-			if err := c.Write([]byte(text)); err != nil {
-				log2.Warnf("write failed: %v", err)
-				defer c.Close()
-				break
-			}
-			resp, err := c.Read()
-			if err != nil {
-				log2.Warn("read failed", zap.Error(err))
-				defer c.Close()
-				break
-			}
-			fmt.Printf("%s\n", string(resp))
+		resp, err := c.Read()
+		if err != nil {
+			log.Warn("read failed", zap.Error(err))
+			p.Invalidate(c)
 			showPrompt()
+			continue
 		}
+		fmt.Printf("%s\n", string(resp))
+		showPrompt()
 	}
+	p.Close()
 	os.Exit(0)
 }
 
@@ -131,7 +135,8 @@ func runServer(broker string, port int) {
 
 	c, cancel := context.WithCancel(context.Background())
 	defer cancel()
-	if err := bk.Start(c, s); err != nil {
+	reg, err := bk.Start(c, s)
+	if err != nil {
 		log.Panic("server start failed", zap.Error(err))
 		return
 	}
@@ -142,8 +147,11 @@ func runServer(broker string, port int) {
 	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
 	wg.Add(1)
 	go func() {
-		s := <-sig
-		log.Info("signal received", zap.Stringer("signal", s))
+		sg := <-sig
+		log.Info("signal received", zap.Stringer("signal", sg))
+		if err := xdisco.Drain(context.TODO(), reg, 10*time.Second, xdisco.DrainOptions{}); err != nil {
+			log.Warn("drain failed", zap.Error(err))
+		}
 		cancel()
 		lis.Close()
 
@@ -21,6 +21,10 @@ type Wacher interface {
 
 // Service ...
 type Sevice interface {
-	Start(context.Context, *server.Server, ...Hook) error
+	Start(context.Context, *server.Server, ...Hook) (Registration, error)
+	Stop(context.Context, *server.Server) error
+
+	// SetState and SetHealth apply to every server registered by the broker.
 	SetState(server.State)
+	SetHealth(ok bool, reason string)
 }
@@ -0,0 +1,41 @@
+package broker
+
+import (
+	"context"
+	"time"
+)
+
+// Coalesce forwards the signals from changed at most once per interval,
+// signals arriving in between are merged into the next one.
+func Coalesce(ctx context.Context, changed <-chan struct{}, interval time.Duration) <-chan struct{} {
+	out := make(chan struct{}, 1)
+	go func() {
+		var last time.Time
+		for {
+			select {
+			case <-changed:
+			case <-ctx.Done():
+				return
+			}
+			if wait := interval - time.Since(last); wait > 0 {
+				timer := time.NewTimer(wait)
+				select {
+				case <-timer.C:
+				case <-ctx.Done():
+					timer.Stop()
+					return
+				}
+			}
+			select {
+			case <-changed:
+			default:
+			}
+			last = time.Now()
+			select {
+			case out <- struct{}{}:
+			default:
+			}
+		}
+	}()
+	return out
+}
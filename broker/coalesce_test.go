@@ -0,0 +1,39 @@
+package broker
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCoalesce(t *testing.T) {
+	assert := assert.New(t)
+	ctx, cancel := context.WithCancel(context.TODO())
+	defer cancel()
+
+	changed := make(chan struct{}, 1)
+	notify := func() {
+		select {
+		case changed <- struct{}{}:
+		default:
+		}
+	}
+	out := Coalesce(ctx, changed, 100*time.Millisecond)
+
+	notify()
+	<-out
+	now := time.Now()
+	for i := 0; i < 10; i++ {
+		notify()
+		time.Sleep(time.Millisecond)
+	}
+	<-out
+	assert.GreaterOrEqual(time.Since(now), 80*time.Millisecond)
+	select {
+	case <-out:
+		assert.Fail("changes should be coalesced")
+	case <-time.After(150 * time.Millisecond):
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"time"
 
 	// "github.com/coreos/etcd/clientv3"
+	"go.etcd.io/etcd/client/pkg/v3/transport"
 	clientv3 "go.etcd.io/etcd/client/v3"
 )
 
@@ -20,6 +21,53 @@ type Options struct {
 
 	// server lease ttl
 	TTL time.Duration `json:"ttl" toml:"ttl" validate:"required"`
+
+	// minimum interval between two writes of a registered server, changes in between are coalesced
+	UpdateInterval time.Duration `json:"updateInterval" toml:"updateInterval"`
+
+	// interval of rewriting an unchanged server to refresh its updatedAt, negative disables it.
+	// the lease is kept alive regardless, the record is written only on changes otherwise.
+	HeartbeatInterval time.Duration `json:"heartbeatInterval" toml:"heartbeatInterval"`
+
+	// prefix applied to every key by the client, used to share a cluster between tenants
+	Namespace string `json:"namespace" toml:"namespace"`
+
+	// username and password of etcd authentication
+	Username string `json:"username" toml:"username"`
+	Password string `json:"password" toml:"password"`
+
+	// client TLS, disabled when nil
+	TLS *TLSOptions `json:"tls" toml:"tls"`
+
+	// keepalive probing of the client connection
+	KeepAliveTime    time.Duration `json:"keepAliveTime" toml:"keepAliveTime"`
+	KeepAliveTimeout time.Duration `json:"keepAliveTimeout" toml:"keepAliveTimeout"`
+
+	// limits of a single request or response in bytes, 0 means the client default
+	MaxCallSendMsgSize int `json:"maxCallSendMsgSize" toml:"maxCallSendMsgSize"`
+	MaxCallRecvMsgSize int `json:"maxCallRecvMsgSize" toml:"maxCallRecvMsgSize"`
+
+	// interval of refreshing endpoints with the cluster members, 0 disables it
+	AutoSyncInterval time.Duration `json:"autoSyncInterval" toml:"autoSyncInterval"`
+}
+
+type TLSOptions struct {
+	// client certificate and key
+	CertFile string `json:"certFile" toml:"certFile"`
+	KeyFile  string `json:"keyFile" toml:"keyFile"`
+
+	// CA bundle to verify the servers
+	CAFile string `json:"caFile" toml:"caFile"`
+
+	// expected name of the servers, default to the host of endpoints
+	ServerName string `json:"serverName" toml:"serverName"`
+}
+
+func (c *TLSOptions) Check() error {
+	if (c.CertFile == "") != (c.KeyFile == "") {
+		return fmt.Errorf("certFile and keyFile must be set together. certFile:%s keyFile:%s", c.CertFile, c.KeyFile)
+	}
+	return nil
 }
 
 func (c *Options) CheckBasic() error {
@@ -42,6 +90,14 @@ func (c *Options) Check() error {
 	if c.Timeout <= 0 {
 		return fmt.Errorf("invalid timeout: %v", c.Timeout)
 	}
+	if c.Password != "" && c.Username == "" {
+		return fmt.Errorf("password without username")
+	}
+	if c.TLS != nil {
+		if err := c.TLS.Check(); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
@@ -59,6 +115,12 @@ func (c *Options) WithDefault() *Options {
 	if c.TTL <= 0 {
 		c.TTL = defaultConfig.TTL
 	}
+	if c.UpdateInterval <= 0 {
+		c.UpdateInterval = defaultConfig.UpdateInterval
+	}
+	if c.HeartbeatInterval == 0 {
+		c.HeartbeatInterval = defaultConfig.HeartbeatInterval
+	}
 	// if err := c.Check(); err != nil {
 	// 	panic(err)
 	// }
@@ -66,11 +128,38 @@ func (c *Options) WithDefault() *Options {
 }
 
 func (c *Options) EtcdConfig() clientv3.Config {
-	c = c.WithDefault()
+	o := *c
+	c = o.WithDefault()
 	return clientv3.Config{
-		Endpoints:   c.Endpoints,
-		DialTimeout: c.Timeout,
+		Endpoints:            c.Endpoints,
+		DialTimeout:          c.Timeout,
+		Username:             c.Username,
+		Password:             c.Password,
+		DialKeepAliveTime:    c.KeepAliveTime,
+		DialKeepAliveTimeout: c.KeepAliveTimeout,
+		MaxCallSendMsgSize:   c.MaxCallSendMsgSize,
+		MaxCallRecvMsgSize:   c.MaxCallRecvMsgSize,
+		AutoSyncInterval:     c.AutoSyncInterval,
+	}
+}
+
+// ClientConfig returns EtcdConfig with the client TLS loaded, which fails on unreadable certificates.
+func (c *Options) ClientConfig() (clientv3.Config, error) {
+	cfg := c.EtcdConfig()
+	if c.TLS != nil {
+		info := transport.TLSInfo{
+			CertFile:      c.TLS.CertFile,
+			KeyFile:       c.TLS.KeyFile,
+			TrustedCAFile: c.TLS.CAFile,
+			ServerName:    c.TLS.ServerName,
+		}
+		tlsConfig, err := info.ClientConfig()
+		if err != nil {
+			return cfg, fmt.Errorf("invalid tls options: %w", err)
+		}
+		cfg.TLS = tlsConfig
 	}
+	return cfg, nil
 }
 
 func DefaultOptions() *Options {
@@ -79,5 +168,8 @@ func DefaultOptions() *Options {
 		Endpoints: []string{"127.0.0.1:2379"},
 		Timeout:   5 * time.Second,
 		TTL:       10 * time.Second,
+
+		UpdateInterval:    time.Second,
+		HeartbeatInterval: 5 * time.Minute,
 	}
 }
@@ -0,0 +1,69 @@
+package etcd
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOptions(t *testing.T) {
+	t.Run("fromJSON", func(t *testing.T) {
+		assert := assert.New(t)
+		data := `{
+			"baseKey": "/xdisco",
+			"endpoints": ["10.0.0.1:2379"],
+			"timeout": 3000000000,
+			"ttl": 10000000000,
+			"username": "xdisco",
+			"password": "secret",
+			"keepAliveTime": 30000000000,
+			"maxCallRecvMsgSize": 1048576,
+			"autoSyncInterval": 60000000000
+		}`
+		opts := Options{}
+		assert.NoError(json.Unmarshal([]byte(data), &opts))
+		assert.NoError(opts.Check())
+		cfg := opts.EtcdConfig()
+		assert.Equal([]string{"10.0.0.1:2379"}, cfg.Endpoints)
+		assert.Equal(3*time.Second, cfg.DialTimeout)
+		assert.Equal("xdisco", cfg.Username)
+		assert.Equal("secret", cfg.Password)
+		assert.Equal(30*time.Second, cfg.DialKeepAliveTime)
+		assert.Equal(1048576, cfg.MaxCallRecvMsgSize)
+		assert.Equal(time.Minute, cfg.AutoSyncInterval)
+		assert.Nil(cfg.TLS)
+	})
+
+	t.Run("tls", func(t *testing.T) {
+		assert := assert.New(t)
+		opts := DefaultOptions()
+		opts.TLS = &TLSOptions{CertFile: "client.crt"}
+		assert.Error(opts.Check())
+
+		opts.TLS = &TLSOptions{ServerName: "etcd.local"}
+		assert.NoError(opts.Check())
+		assert.Nil(opts.EtcdConfig().TLS)
+		cfg, err := opts.ClientConfig()
+		assert.NoError(err)
+		if assert.NotNil(cfg.TLS) {
+			assert.Equal("etcd.local", cfg.TLS.ServerName)
+		}
+
+		opts.TLS = &TLSOptions{CertFile: "missing.crt", KeyFile: "missing.key"}
+		_, err = opts.ClientConfig()
+		assert.Error(err)
+	})
+	t.Run("notMutated", func(t *testing.T) {
+		assert := assert.New(t)
+		opts := &Options{Endpoints: []string{"127.0.0.1:1"}}
+		cfg := opts.EtcdConfig()
+		assert.Equal(DefaultOptions().Timeout, cfg.DialTimeout)
+		bk, err := NewWithConfig(opts, cfg)
+		assert.NoError(err)
+		defer bk.client.Close()
+		assert.Equal(&Options{Endpoints: []string{"127.0.0.1:1"}}, opts)
+		assert.Equal(DefaultOptions().TTL, bk.opts.TTL)
+	})
+}
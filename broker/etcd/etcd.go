@@ -5,6 +5,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"strings"
+	"sync"
 	"time"
 
 	// "github.com/coreos/etcd/clientv3"
@@ -14,7 +15,7 @@ import (
 	"github.com/cupen/xdisco/logs"
 	"github.com/cupen/xdisco/server"
 	clientv3 "go.etcd.io/etcd/client/v3"
-	"golang.org/x/time/rate"
+	"go.etcd.io/etcd/client/v3/namespace"
 )
 
 var (
@@ -23,18 +24,31 @@ var (
 )
 
 type Etcd struct {
-	opts      *Options
-	cfg       clientv3.Config
-	client    *clientv3.Client
-	cacheKeys map[string]struct{}
-	stateCh   chan server.State
+	opts   *Options
+	cfg    clientv3.Config
+	client *clientv3.Client
+
+	mu   sync.Mutex // guards regs and the callbacks
+	regs map[string]*registration
+
+	onLeaseLost    func(*server.Server)
+	onReregistered func(*server.Server)
 }
 
+const (
+	retryMinBackoff = 500 * time.Millisecond
+	retryMaxBackoff = 30 * time.Second
+)
+
 func New(opts *Options) (*Etcd, error) {
 	if err := opts.Check(); err != nil {
 		return nil, err
 	}
-	return NewWithConfig(opts, opts.EtcdConfig())
+	cfg, err := opts.ClientConfig()
+	if err != nil {
+		return nil, err
+	}
+	return NewWithConfig(opts, cfg)
 }
 
 func NewWithConfig(opts *Options, cfg clientv3.Config) (*Etcd, error) {
@@ -45,19 +59,29 @@ func NewWithConfig(opts *Options, cfg clientv3.Config) (*Etcd, error) {
 	if cli == nil {
 		return nil, fmt.Errorf("failed to connect etcd. cfg: %+v", cfg)
 	}
+	if ns := opts.Namespace; ns != "" {
+		cli.KV = namespace.NewKV(cli.KV, ns)
+		cli.Watcher = namespace.NewWatcher(cli.Watcher, ns)
+		cli.Lease = namespace.NewLease(cli.Lease, ns)
+	}
+	// the defaults are filled in a copy, the options of the caller are left as given.
+	o := *opts
 	return &Etcd{
-		opts:      opts,
-		cfg:       cfg,
-		client:    cli,
-		cacheKeys: map[string]struct{}{},
+		opts:   o.WithDefault(),
+		cfg:    cfg,
+		client: cli,
+		regs:   map[string]*registration{},
 	}, nil
 }
 
-func (e *Etcd) initWatch() {
-	if e.stateCh != nil {
-		close(e.stateCh)
-	}
-	e.stateCh = make(chan server.State)
+// Client returns the etcd client of the broker, shared by the components built on it.
+func (e *Etcd) Client() *clientv3.Client {
+	return e.client
+}
+
+// BaseKey returns the keyspace of the broker.
+func (e *Etcd) BaseKey() string {
+	return e.opts.BaseKey
 }
 
 func (e *Etcd) Watch(ctx context.Context, kind string, h eventhandler.Handler, checker server.Checker) error {
@@ -68,47 +92,27 @@ func (e *Etcd) Watch(ctx context.Context, kind string, h eventhandler.Handler, c
 	now := time.Now()
 	fullKey := e.buildKeyOfList(kind)
 	log2.Infof(logPrefix+"starting: %s", fullKey)
-	watchCh := e.client.Watch(ctx, fullKey, clientv3.WithPrefix())
 
 	pingTS := time.Now()
 	// servers, err := e.fetchServersAlived(fullKey, checker)
-	servers, err := e.fetchServers(fullKey)
+	snap, err := e.fetchServers(fullKey)
 	if err != nil {
 		return err
 	}
-	log2.Infof(logPrefix+"%d servers found", len(servers))
-	h.OnInit(servers)
-	for _, s := range servers {
-		e.cacheKeys[s.GetKey()] = struct{}{}
-	}
+	// watch from the revision right after the list, so no event is missed or duplicated.
+	watchCh := e.client.Watch(clientv3.WithRequireLeader(ctx), fullKey,
+		clientv3.WithPrefix(), clientv3.WithRev(snap.rev+1))
+	log2.Infof(logPrefix+"%d servers found at revision %d", len(snap.servers), snap.rev)
+	h.OnInit(snap.servers)
+	w := newWatcher(e, fullKey, h, logPrefix)
+	w.keys = snap.contents
+	w.rev = snap.rev
 	pingCost := time.Since(pingTS)
-	e.initWatch()
-	go e.startWatch(ctx, watchCh, h)
+	go w.run(ctx, watchCh)
 	log2.Infof(logPrefix+" started: %s cost:%v, ping:%v", fullKey, time.Since(now), pingCost)
 	return nil
 }
 
-func (e *Etcd) startWatch(ctx context.Context, watchCh clientv3.WatchChan, h eventhandler.Handler) {
-	limit := rate.NewLimiter(rate.Every(time.Second), 100)
-	for {
-		select {
-		case resp := <-watchCh:
-			if err := resp.Err(); err != nil {
-				log2.Error("[etcd] invalid watch response. err:%v", err)
-				limit.Wait(ctx)
-				continue
-			}
-			if err := e.handleWatchResponse(h, &resp); err != nil {
-				log2.Error("[etcd] invalid watch response. err:%v", err)
-				limit.Wait(ctx)
-				continue
-			}
-		case <-ctx.Done():
-			return
-		}
-	}
-}
-
 // Ping ...
 func (e *Etcd) Ping() error {
 	ctx, cancel := context.WithTimeout(context.TODO(), 3*time.Second)
@@ -133,41 +137,14 @@ func (e *Etcd) Ping() error {
 	return nil
 }
 
-func (e *Etcd) handleWatchResponse(h eventhandler.Handler, resp *clientv3.WatchResponse) error {
-	if !h.IsValid() {
-		panic(fmt.Errorf("invalid handler"))
-	}
-	if err := resp.Err(); err != nil {
-		return err
-	}
-	if len(resp.Events) <= 0 {
-		return fmt.Errorf("empty etcd events")
-	}
-	for _, ev := range resp.Events {
-		key := string(ev.Kv.Key)
-		switch ev.Type {
-		case clientv3.EventTypePut:
-			s, err := server.NewServerFromEtcd(key, ev.Kv.Value)
-			if err != nil {
-				return fmt.Errorf("invalid event data: parsing failed. key=%s err:%w. ", key, err)
-			}
-			if _, exists := e.cacheKeys[key]; !exists {
-				h.OnAdd(key, s)
-			} else {
-				h.OnUpdate(key, s)
-			}
-			e.cacheKeys[key] = struct{}{}
-		case clientv3.EventTypeDelete:
-			delete(e.cacheKeys, key)
-			h.OnDelete(key)
-		default:
-			return fmt.Errorf("invalid event type: %s event: %+v", ev.Type, ev)
-		}
-	}
-	return nil
+// snapshot is the servers listed at a revision.
+type snapshot struct {
+	servers  []*server.Server
+	contents map[string]string // content of each server key, see contentOf
+	rev      int64
 }
 
-func (e *Etcd) fetchServers(fullKey string) ([]*server.Server, error) {
+func (e *Etcd) fetchServers(fullKey string) (*snapshot, error) {
 	client := e.client
 	if client == nil {
 		return nil, fmt.Errorf("nil etcd client")
@@ -177,11 +154,15 @@ func (e *Etcd) fetchServers(fullKey string) ([]*server.Server, error) {
 	defer cancel()
 
 	resp, err := client.Get(ctx, key, clientv3.WithPrefix())
-	if err != nil || len(resp.Kvs) <= 0 {
+	if err != nil {
 		return nil, err
 	}
 
-	slist := []*server.Server{}
+	snap := &snapshot{
+		servers:  []*server.Server{},
+		contents: map[string]string{},
+		rev:      resp.Header.Revision,
+	}
 	for _, pair := range resp.Kvs {
 		data := pair.Value
 		s := server.Server{}
@@ -194,141 +175,114 @@ func (e *Etcd) fetchServers(fullKey string) ([]*server.Server, error) {
 			continue
 		}
 		s.SetKey(string(pair.Key))
-		slist = append(slist, &s)
+		content, err := contentOf(&s)
+		if err != nil {
+			log2.Warnf("fetch servers failed: invalid data: key=%s err:%v", pair.Key, err)
+			continue
+		}
+		snap.servers = append(snap.servers, &s)
+		snap.contents[string(pair.Key)] = string(content)
 	}
-	return slist, nil
+	return snap, nil
 }
 
 func (e *Etcd) fetchServersAlived(fullKey string, hc server.Checker) ([]*server.Server, error) {
-	servers, err := e.fetchServers(fullKey)
+	snap, err := e.fetchServers(fullKey)
 	if err != nil {
 		return nil, err
 	}
-	alives, _ := server.Filter(servers, hc)
+	alives, _ := server.Filter(snap.servers, hc)
 	return alives, nil
 }
 
 func (e *Etcd) newLeagueID(ttl time.Duration) (clientv3.LeaseID, error) {
-	lease := clientv3.NewLease(e.client)
 	ttlSecs := int64(ttl / time.Second)
-	resp, err := lease.Grant(context.TODO(), ttlSecs)
+	if ttlSecs < 1 {
+		ttlSecs = 1
+	}
+	ctx, cancel := context.WithTimeout(context.TODO(), e.opts.Timeout)
+	defer cancel()
+	resp, err := e.client.Grant(ctx, ttlSecs)
 	if err != nil {
 		return 0, err
 	}
 	return resp.ID, nil
 }
 
-func (e *Etcd) Start(ctx context.Context, s *server.Server, hooks ...broker.Hook) error {
+func (e *Etcd) Start(ctx context.Context, s *server.Server, hooks ...broker.Hook) (broker.Registration, error) {
 	if !s.IsValid() {
-		return fmt.Errorf("invalid server: %+v", s)
+		return nil, fmt.Errorf("invalid server: %+v", s)
 	}
 	key := e.buildKey(s.Kind, s.ID)
-	data, err := json.Marshal(s)
-	if err != nil {
-		return err
-	}
-
 	s.SetStatus(server.States.Running)
-	ttl := e.opts.TTL
-	if ttl < 30*time.Second {
-		ttl = 30 * time.Second
-	}
-	leaseId, err := e.newLeagueID(ttl)
-	if err != nil {
-		return err
-	}
-	_, err = e.client.Put(ctx, key, string(data), clientv3.WithLease(leaseId))
+	ctx, cancel := context.WithCancel(ctx)
+	sess, err := e.register(ctx, key, s)
 	if err != nil {
+		cancel()
 		log2.Warnf("[etcd] server start failed!!!. key=%s err:%v", key, err)
-		return err
-	}
-
-	keepaliveCh, err := e.client.KeepAlive(ctx, leaseId)
-	if err != nil {
-		return err
+		return nil, err
 	}
 
 	log2.Infof("[etcd] server started. key=%s", key)
-	go func() {
-		for {
-			select {
-			case <-keepaliveCh:
-				if len(hooks) > 0 {
-					hooks[0](s)
-				}
-				s.UpdatedAt = time.Now()
-				if err := e.update(s, &leaseId); err != nil {
-					log2.Warnf("[etcd] server update failed!! err:%v", err)
-				}
-			case state := <-e.stateCh:
-				s.SetStatus(state)
-				s.UpdatedAt = time.Now()
-				if err := e.update(s, &leaseId); err != nil {
-					log2.Warnf("[etcd] server update failed!!. err:%v", err)
-				}
-			case <-ctx.Done():
-				if err := e.stop(s); err != nil {
-					log2.Infof("[etcd] server stopped. key=%s but err:%v", key, err)
-				} else {
-					log2.Infof("[etcd] server stopped. key=%s", key)
-				}
-				return
-			}
-		}
-	}()
-	return nil
+	reg := newRegistration(s, cancel)
+	e.mu.Lock()
+	e.regs[key] = reg
+	e.mu.Unlock()
+	go e.keepRegistered(ctx, key, reg, sess, hooks)
+	return reg, nil
 }
 
-func (e *Etcd) update(s *server.Server, leaseId *clientv3.LeaseID) error {
+// OnLeaseLost sets the callback invoked when the lease of a registered server is lost,
+// the server is invisible to watchers until it is re-registered.
+func (e *Etcd) OnLeaseLost(callback func(*server.Server)) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.onLeaseLost = callback
+}
+
+// OnReregistered sets the callback invoked when a server is registered again after its lease was lost.
+func (e *Etcd) OnReregistered(callback func(*server.Server)) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.onReregistered = callback
+}
+
+// Stop stops keeping s alive and deregisters it right away,
+// rather than waiting for the context given to Start to be cancelled.
+func (e *Etcd) Stop(ctx context.Context, s *server.Server) error {
 	if !s.IsValid() {
 		return fmt.Errorf("invalid server: %+v", s)
 	}
 	key := e.buildKey(s.Kind, s.ID)
-	data, err := json.Marshal(s)
-	if err != nil {
-		return err
-	}
-	ctx, cancel := context.WithTimeout(context.TODO(), 6*time.Second)
-	defer cancel()
-
-	_, err = e.client.Put(ctx, key, string(data), clientv3.WithLease(*leaseId))
-	if err != nil {
-		log2.Warnf("[etcd] server keepalive failed!!!. key=%s err:%v", key, err)
-		_leaseId, err := e.newLeagueID(30 * time.Second)
-		if err != nil {
-			log2.Errorf("[etcd] server update failed!!!. key=%s err:%v", key, err)
-			return err
-		}
-		*leaseId = _leaseId
-		_, err = e.client.Put(ctx, key, string(data), clientv3.WithLease(*leaseId))
-		if err != nil {
-			log2.Errorf("[etcd] server update failed!!!. key=%s err:%v", key, err)
-			return err
-		}
-		return err
+	e.mu.Lock()
+	reg, ok := e.regs[key]
+	e.mu.Unlock()
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrNotRegistered, key)
 	}
-	return err
+	return reg.Deregister(ctx)
 }
 
-func (e *Etcd) stop(s *server.Server) error {
-	if !s.IsValid() {
-		return fmt.Errorf("invalid server: %+v", s)
+func (e *Etcd) registrations() []*registration {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	regs := make([]*registration, 0, len(e.regs))
+	for _, reg := range e.regs {
+		regs = append(regs, reg)
 	}
-	ctx, cancel := context.WithTimeout(context.TODO(), 6*time.Second)
-	defer cancel()
+	return regs
+}
 
-	key := e.buildKey(s.Kind, s.ID)
-	_, err := e.client.Delete(ctx, key)
-	if err != nil {
-		log2.Errorf("[etcd] server stop failed. key=%s err:%v ", key, err)
-		return err
+func (e *Etcd) SetState(state server.State) {
+	for _, reg := range e.registrations() {
+		reg.SetState(state)
 	}
-	log2.Infof("[etcd] server stopped. key=%s", key)
-	return nil
 }
 
-func (e *Etcd) SetState(state server.State) {
-	e.stateCh <- state
+func (e *Etcd) SetHealth(ok bool, reason string) {
+	for _, reg := range e.registrations() {
+		reg.SetHealth(ok, reason)
+	}
 }
 
 func (e *Etcd) buildKey(kind, id string) string {
@@ -0,0 +1,31 @@
+package etcd
+
+import (
+	"context"
+
+	"github.com/cupen/xdisco/broker"
+	"github.com/cupen/xdisco/server"
+)
+
+type registration struct {
+	*broker.Record
+	cancel context.CancelFunc
+	err    error // result of the deregistration, valid after Done
+}
+
+func newRegistration(s *server.Server, cancel context.CancelFunc) *registration {
+	return &registration{
+		Record: broker.NewRecord(s),
+		cancel: cancel,
+	}
+}
+
+func (r *registration) Deregister(ctx context.Context) error {
+	r.cancel()
+	select {
+	case <-r.Done():
+		return r.err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
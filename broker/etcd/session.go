@@ -0,0 +1,250 @@
+package etcd
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/cupen/xdisco/broker"
+	"github.com/cupen/xdisco/server"
+	"go.etcd.io/etcd/api/v3/v3rpc/rpctypes"
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+// ErrDuplicated means the server key is held by another registration,
+// usually another process started with the same server ID.
+var ErrDuplicated = errors.New("server registered by another process")
+
+// ErrNotRegistered means the server to stop was not started by this broker,
+// its key is left untouched since it may belong to another process.
+var ErrNotRegistered = errors.New("server not registered by this broker")
+
+// errRecordLost means the record of a registration is gone while its lease is alive.
+var errRecordLost = errors.New("server record lost")
+
+// session is a record of a server bound to a lease.
+type session struct {
+	leaseId   clientv3.LeaseID
+	rev       int64  // mod revision of the last write
+	content   []byte // the last server written, without updatedAt
+	keepalive <-chan *clientv3.LeaseKeepAliveResponse
+}
+
+// contentOf marshals s without updatedAt, so refreshing it alone is not seen as a change.
+func contentOf(s *server.Server) ([]byte, error) {
+	s = s.Clone()
+	s.UpdatedAt = time.Time{}
+	return json.Marshal(s)
+}
+
+// register creates the record of s under a new lease and keeps the lease alive until ctx is done.
+// It fails with ErrDuplicated if the key exists already.
+func (e *Etcd) register(ctx context.Context, key string, s *server.Server) (*session, error) {
+	s = s.Clone()
+	s.UpdatedAt = time.Now()
+	content, err := contentOf(s)
+	if err != nil {
+		return nil, err
+	}
+	data, err := json.Marshal(s)
+	if err != nil {
+		return nil, err
+	}
+	leaseId, err := e.newLeagueID(e.opts.TTL)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := e.client.Txn(ctx).
+		If(clientv3.Compare(clientv3.CreateRevision(key), "=", 0)).
+		Then(clientv3.OpPut(key, string(data), clientv3.WithLease(leaseId))).
+		Else(clientv3.OpGet(key)).
+		Commit()
+	if err != nil {
+		e.revoke(leaseId)
+		return nil, err
+	}
+	if !resp.Succeeded {
+		e.revoke(leaseId)
+		holder := int64(0)
+		if kvs := resp.Responses[0].GetResponseRange().Kvs; len(kvs) > 0 {
+			holder = kvs[0].Lease
+		}
+		return nil, fmt.Errorf("%w. key=%s lease=%x", ErrDuplicated, key, holder)
+	}
+	keepaliveCh, err := e.client.KeepAlive(ctx, leaseId)
+	if err != nil {
+		e.revoke(leaseId)
+		return nil, err
+	}
+	return &session{
+		leaseId:   leaseId,
+		rev:       resp.Header.Revision,
+		content:   content,
+		keepalive: keepaliveCh,
+	}, nil
+}
+
+func (e *Etcd) keepRegistered(ctx context.Context, key string, reg *registration, sess *session, hooks []broker.Hook) {
+	defer reg.Close()
+	changed := broker.Coalesce(ctx, reg.Changed(), e.opts.UpdateInterval)
+	var heartbeat <-chan time.Time
+	if e.opts.HeartbeatInterval > 0 {
+		ticker := time.NewTicker(e.opts.HeartbeatInterval)
+		defer ticker.Stop()
+		heartbeat = ticker.C
+	}
+	publish := func(force bool) error {
+		err := e.update(key, reg.Server(), sess, force)
+		switch {
+		case err == nil:
+		case errors.Is(err, rpctypes.ErrLeaseNotFound), errors.Is(err, errRecordLost):
+			// registering again writes the current server.
+			sess = e.reregister(ctx, key, reg, sess)
+			return ctx.Err()
+		case errors.Is(err, ErrDuplicated):
+			log2.Errorf("[etcd] server update refused!!!. key=%s err:%v", key, err)
+		default:
+			log2.Warnf("[etcd] server update failed!!. key=%s err:%v", key, err)
+		}
+		return err
+	}
+	for {
+		select {
+		case resp, ok := <-sess.keepalive:
+			if ctx.Err() != nil {
+				// the keepalive is closed with ctx, let ctx.Done stop the server.
+				sess.keepalive = nil
+				continue
+			}
+			if !ok || resp == nil {
+				sess = e.reregister(ctx, key, reg, sess)
+				continue
+			}
+			// the lease is refreshed, hooks are written only if they change the server.
+			for _, hook := range hooks {
+				reg.Update(hook)
+			}
+		case <-changed:
+			publish(false)
+		case req := <-reg.Flushes():
+			req <- publish(false)
+		case <-heartbeat:
+			publish(true)
+		case <-ctx.Done():
+			e.mu.Lock()
+			if e.regs[key] == reg {
+				delete(e.regs, key)
+			}
+			e.mu.Unlock()
+			// revoking the lease deletes the record, and only ours.
+			if sess.leaseId != 0 {
+				reg.err = e.revoke(sess.leaseId)
+			}
+			if reg.err != nil {
+				log2.Infof("[etcd] server stopped. key=%s but err:%v", key, reg.err)
+			} else {
+				log2.Infof("[etcd] server stopped. key=%s", key)
+			}
+			return
+		}
+	}
+}
+
+// reregister registers the server again under a new lease after the old one was lost,
+// retrying with exponential backoff until it succeeds or ctx is done.
+func (e *Etcd) reregister(ctx context.Context, key string, reg *registration, lost *session) *session {
+	log2.Warnf("[etcd] server lease lost!!!. key=%s lease=%x", key, lost.leaseId)
+	e.mu.Lock()
+	onLeaseLost, onReregistered := e.onLeaseLost, e.onReregistered
+	e.mu.Unlock()
+	if onLeaseLost != nil {
+		onLeaseLost(reg.Server())
+	}
+	// the lease may be alive with its record gone, drop it rather than keeping it alive for nothing.
+	if lost.leaseId != 0 {
+		e.revoke(lost.leaseId)
+	}
+	backoff := retryMinBackoff
+	for {
+		sess, err := e.register(ctx, key, reg.Server())
+		if err == nil {
+			log2.Infof("[etcd] server re-registered. key=%s lease=%x", key, sess.leaseId)
+			if onReregistered != nil {
+				onReregistered(reg.Server())
+			}
+			return sess
+		}
+		if ctx.Err() != nil {
+			return &session{}
+		}
+		log2.Warnf("[etcd] server re-register failed!!. key=%s retry in %v. err:%v", key, backoff, err)
+		timer := time.NewTimer(backoff)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return &session{}
+		}
+		backoff *= 2
+		if backoff > retryMaxBackoff {
+			backoff = retryMaxBackoff
+		}
+	}
+}
+
+// update writes s if the record is still the one written last by the session.
+// Unless forced, s is skipped when nothing but updatedAt differs from the last write.
+func (e *Etcd) update(key string, s *server.Server, sess *session, force bool) error {
+	if !s.IsValid() {
+		return fmt.Errorf("invalid server: %+v", s)
+	}
+	content, err := contentOf(s)
+	if err != nil {
+		return err
+	}
+	if !force && bytes.Equal(content, sess.content) {
+		return nil
+	}
+	s.UpdatedAt = time.Now()
+	data, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.TODO(), 6*time.Second)
+	defer cancel()
+
+	resp, err := e.client.Txn(ctx).
+		If(clientv3.Compare(clientv3.ModRevision(key), "=", sess.rev)).
+		Then(clientv3.OpPut(key, string(data), clientv3.WithLease(sess.leaseId))).
+		Else(clientv3.OpGet(key)).
+		Commit()
+	if err != nil {
+		return err
+	}
+	if !resp.Succeeded {
+		kvs := resp.Responses[0].GetResponseRange().Kvs
+		if len(kvs) <= 0 {
+			return errRecordLost
+		}
+		if kvs[0].Lease != int64(sess.leaseId) {
+			return fmt.Errorf("%w. key=%s lease=%x", ErrDuplicated, key, kvs[0].Lease)
+		}
+		return fmt.Errorf("record changed at revision %d. key=%s", kvs[0].ModRevision, key)
+	}
+	sess.rev = resp.Header.Revision
+	sess.content = content
+	return nil
+}
+
+func (e *Etcd) revoke(leaseId clientv3.LeaseID) error {
+	ctx, cancel := context.WithTimeout(context.TODO(), 6*time.Second)
+	defer cancel()
+	if _, err := e.client.Revoke(ctx, leaseId); err != nil && !errors.Is(err, rpctypes.ErrLeaseNotFound) {
+		log2.Warnf("[etcd] revoke lease failed. lease=%x err:%v", leaseId, err)
+		return err
+	}
+	return nil
+}
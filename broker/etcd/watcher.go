@@ -0,0 +1,147 @@
+package etcd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/cupen/xdisco/eventhandler"
+	"github.com/cupen/xdisco/server"
+	"go.etcd.io/etcd/api/v3/v3rpc/rpctypes"
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"golang.org/x/time/rate"
+)
+
+var errWatchClosed = errors.New("watch channel closed")
+
+// watcher keeps the servers under a prefix in sync with the handler.
+// It tracks the last revision seen so a broken watch can be resumed without gaps,
+// and falls back to a full re-list when that revision has been compacted.
+type watcher struct {
+	e         *Etcd
+	prefix    string
+	h         eventhandler.Handler
+	keys      map[string]string // content of the known servers, see contentOf
+	rev       int64             // last revision observed
+	logPrefix string
+}
+
+func newWatcher(e *Etcd, prefix string, h eventhandler.Handler, logPrefix string) *watcher {
+	return &watcher{
+		e:         e,
+		prefix:    prefix,
+		h:         h,
+		keys:      map[string]string{},
+		logPrefix: logPrefix,
+	}
+}
+
+func (w *watcher) run(ctx context.Context, watchCh clientv3.WatchChan) {
+	limit := rate.NewLimiter(rate.Every(time.Second), 3)
+	for {
+		err := w.consume(ctx, watchCh)
+		if ctx.Err() != nil {
+			log2.Infof(w.logPrefix+"stopped: %s", w.prefix)
+			return
+		}
+		log2.Warnf(w.logPrefix+"watch broken at revision %d. err:%v", w.rev, err)
+		limit.Wait(ctx)
+		if errors.Is(err, rpctypes.ErrCompacted) || w.rev <= 0 {
+			if err := w.resync(); err != nil {
+				log2.Warnf(w.logPrefix+"resync failed. err:%v", err)
+				continue
+			}
+		}
+		watchCh = w.e.client.Watch(clientv3.WithRequireLeader(ctx), w.prefix,
+			clientv3.WithPrefix(), clientv3.WithRev(w.rev+1))
+		log2.Infof(w.logPrefix+"resumed from revision %d", w.rev+1)
+	}
+}
+
+func (w *watcher) consume(ctx context.Context, watchCh clientv3.WatchChan) error {
+	for {
+		select {
+		case resp, ok := <-watchCh:
+			if !ok {
+				return errWatchClosed
+			}
+			if resp.CompactRevision > 0 {
+				return rpctypes.ErrCompacted
+			}
+			if err := resp.Err(); err != nil {
+				return err
+			}
+			w.handle(&resp)
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+func (w *watcher) handle(resp *clientv3.WatchResponse) {
+	for _, ev := range resp.Events {
+		key := string(ev.Kv.Key)
+		w.rev = ev.Kv.ModRevision
+		switch ev.Type {
+		case clientv3.EventTypePut:
+			s, err := server.NewServerFromEtcd(key, ev.Kv.Value)
+			if err != nil {
+				log2.Warnf(w.logPrefix+"invalid event data: parsing failed. key=%s err:%v", key, err)
+				continue
+			}
+			content, err := contentOf(s)
+			if err != nil {
+				log2.Warnf(w.logPrefix+"invalid event data: marshal failed. key=%s err:%v", key, err)
+				continue
+			}
+			old, exists := w.keys[key]
+			w.keys[key] = string(content)
+			// the heartbeat rewrites only updatedAt, which is no change to the watchers.
+			if !exists {
+				w.h.OnAdd(key, s)
+			} else if old != string(content) {
+				w.h.OnUpdate(key, s)
+			}
+		case clientv3.EventTypeDelete:
+			if _, exists := w.keys[key]; !exists {
+				continue
+			}
+			delete(w.keys, key)
+			w.h.OnDelete(key)
+		default:
+			log2.Warnf(w.logPrefix+"invalid event type: %s event: %+v", ev.Type, ev)
+		}
+	}
+}
+
+// resync lists the servers again and emits the difference to the known ones.
+func (w *watcher) resync() error {
+	snap, err := w.e.fetchServers(w.prefix)
+	if err != nil {
+		return fmt.Errorf("list servers failed. %w", err)
+	}
+	added, updated, deleted := 0, 0, 0
+	for _, s := range snap.servers {
+		key := s.GetKey()
+		content, exists := w.keys[key]
+		switch {
+		case !exists:
+			w.h.OnAdd(key, s)
+			added++
+		case content != snap.contents[key]:
+			w.h.OnUpdate(key, s)
+			updated++
+		}
+	}
+	for key := range w.keys {
+		if _, exists := snap.contents[key]; !exists {
+			w.h.OnDelete(key)
+			deleted++
+		}
+	}
+	w.keys = snap.contents
+	w.rev = snap.rev
+	log2.Infof(w.logPrefix+"resynced at revision %d. added:%d updated:%d deleted:%d", w.rev, added, updated, deleted)
+	return nil
+}
@@ -0,0 +1,180 @@
+package etcd
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cupen/xdisco/eventhandler"
+	"github.com/cupen/xdisco/server"
+	"github.com/stretchr/testify/assert"
+	pb "go.etcd.io/etcd/api/v3/etcdserverpb"
+	"go.etcd.io/etcd/api/v3/mvccpb"
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+// memKV keeps the keys in memory, only listing a prefix is supported.
+type memKV struct {
+	clientv3.KV
+	mu  sync.Mutex
+	rev int64
+	kvs map[string]*mvccpb.KeyValue
+}
+
+func (kv *memKV) put(t *testing.T, key string, s *server.Server) *clientv3.Event {
+	data, err := json.Marshal(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	kv.rev++
+	pair := &mvccpb.KeyValue{Key: []byte(key), Value: data, ModRevision: kv.rev}
+	kv.kvs[key] = pair
+	return &clientv3.Event{Type: clientv3.EventTypePut, Kv: pair}
+}
+
+func (kv *memKV) delete(key string) *clientv3.Event {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	kv.rev++
+	delete(kv.kvs, key)
+	return &clientv3.Event{Type: clientv3.EventTypeDelete, Kv: &mvccpb.KeyValue{Key: []byte(key), ModRevision: kv.rev}}
+}
+
+func (kv *memKV) Get(ctx context.Context, key string, opts ...clientv3.OpOption) (*clientv3.GetResponse, error) {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	resp := &clientv3.GetResponse{Header: &pb.ResponseHeader{Revision: kv.rev}}
+	for k, pair := range kv.kvs {
+		if strings.HasPrefix(k, key) {
+			resp.Kvs = append(resp.Kvs, pair)
+		}
+	}
+	sort.Slice(resp.Kvs, func(i, j int) bool {
+		return string(resp.Kvs[i].Key) < string(resp.Kvs[j].Key)
+	})
+	return resp, nil
+}
+
+// chanWatcher hands out the watch channels opened by the watcher.
+type chanWatcher struct {
+	clientv3.Watcher
+	opened chan chan clientv3.WatchResponse
+}
+
+func (w *chanWatcher) Watch(ctx context.Context, key string, opts ...clientv3.OpOption) clientv3.WatchChan {
+	ch := make(chan clientv3.WatchResponse, 10)
+	w.opened <- ch
+	return ch
+}
+
+func TestWatcher_ResyncAfterCompaction(t *testing.T) {
+	assert := assert.New(t)
+	kv := &memKV{kvs: map[string]*mvccpb.KeyValue{}}
+	cw := &chanWatcher{opened: make(chan chan clientv3.WatchResponse, 1)}
+	cli := clientv3.NewCtxClient(context.TODO())
+	cli.KV = kv
+	cli.Watcher = cw
+	e := &Etcd{opts: DefaultOptions(), client: cli}
+
+	kind := "compacted"
+	prefix := e.buildKeyOfList(kind)
+	put := func(id string, status ...string) *clientv3.Event {
+		s := server.NewServer(id, kind, "127.0.0.1")
+		if len(status) > 0 {
+			s.Status = status[0]
+		}
+		return kv.put(t, e.buildKey(kind, id), s)
+	}
+	var mu sync.Mutex
+	events := []string{}
+	record := func(ev string) {
+		mu.Lock()
+		defer mu.Unlock()
+		events = append(events, ev)
+	}
+	has := func(ev string) bool {
+		mu.Lock()
+		defer mu.Unlock()
+		for _, e := range events {
+			if e == ev {
+				return true
+			}
+		}
+		return false
+	}
+	h := eventhandler.Handler{
+		OnInit:   func(servers []*server.Server) {},
+		OnAdd:    func(key string, s *server.Server) { record("add:" + s.ID) },
+		OnUpdate: func(key string, s *server.Server) { record(fmt.Sprintf("update:%s", s.ID)) },
+		OnDelete: func(key string) { record("delete:" + key) },
+	}
+
+	put("1")
+	put("2")
+	w := newWatcher(e, prefix, h, "[test] ")
+	assert.NoError(w.resync())
+	assert.Equal([]string{"add:1", "add:2"}, events)
+
+	// changes missed by the watcher, then compacted away
+	put("2", string(server.States.Stopping))
+	put("3")
+	kv.delete(e.buildKey(kind, "1"))
+
+	ctx, cancel := context.WithCancel(context.TODO())
+	defer cancel()
+	watchCh := make(chan clientv3.WatchResponse, 1)
+	watchCh <- clientv3.WatchResponse{CompactRevision: kv.rev}
+	go w.run(ctx, watchCh)
+
+	var resumed chan clientv3.WatchResponse
+	select {
+	case resumed = <-cw.opened:
+	case <-time.After(3 * time.Second):
+		t.Fatal("watch not resumed")
+	}
+	assert.True(has("delete:" + e.buildKey(kind, "1")))
+	assert.True(has("add:3"))
+	assert.True(has("update:2"))
+	assert.Equal(kv.rev, w.rev)
+
+	// watching goes on after the resync
+	resumed <- clientv3.WatchResponse{Events: []*clientv3.Event{put("4")}}
+	assert.Eventually(func() bool { return has("add:4") }, 3*time.Second, 10*time.Millisecond)
+}
+
+func TestWatcher_HeartbeatOnly(t *testing.T) {
+	assert := assert.New(t)
+	kv := &memKV{kvs: map[string]*mvccpb.KeyValue{}}
+	e := &Etcd{opts: DefaultOptions()}
+	kind := "heartbeat"
+	key := e.buildKey(kind, "1")
+	events := []string{}
+	h := eventhandler.Handler{
+		OnAdd:    func(key string, s *server.Server) { events = append(events, "add:"+s.ID) },
+		OnUpdate: func(key string, s *server.Server) { events = append(events, "update:"+s.ID+":"+s.Status) },
+		OnDelete: func(key string) { events = append(events, "delete:"+key) },
+	}
+	w := newWatcher(e, e.buildKeyOfList(kind), h, "[test] ")
+
+	s := server.NewServer("1", kind, "127.0.0.1")
+	s.UpdatedAt = time.Now()
+	w.handle(&clientv3.WatchResponse{Events: []*clientv3.Event{kv.put(t, key, s)}})
+
+	// the heartbeat rewrites only updatedAt
+	s.UpdatedAt = s.UpdatedAt.Add(time.Second)
+	w.handle(&clientv3.WatchResponse{Events: []*clientv3.Event{kv.put(t, key, s)}})
+	assert.Equal([]string{"add:1"}, events)
+
+	s.UpdatedAt = s.UpdatedAt.Add(time.Second)
+	s.Status = string(server.States.Stopping)
+	w.handle(&clientv3.WatchResponse{Events: []*clientv3.Event{kv.put(t, key, s)}})
+	assert.Equal([]string{"add:1", "update:1:stopping"}, events)
+	assert.Equal(kv.rev, w.rev)
+}
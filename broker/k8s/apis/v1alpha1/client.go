@@ -0,0 +1,123 @@
+package v1alpha1
+
+import (
+	"context"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/dynamic"
+)
+
+// Client is a typed client of the xdisco.io resources, built on the dynamic client.
+type Client struct {
+	dyn dynamic.Interface
+}
+
+func NewClient(dyn dynamic.Interface) *Client {
+	return &Client{dyn: dyn}
+}
+
+func (c *Client) XdiscoServers(namespace string) *XdiscoServers {
+	return &XdiscoServers{
+		api: c.dyn.Resource(XdiscoServerResource).Namespace(namespace),
+	}
+}
+
+// XdiscoServers is the client of the XdiscoServers in a namespace.
+type XdiscoServers struct {
+	api dynamic.ResourceInterface
+}
+
+func (c *XdiscoServers) Get(ctx context.Context, name string, opts metav1.GetOptions) (*XdiscoServer, error) {
+	u, err := c.api.Get(ctx, name, opts)
+	if err != nil {
+		return nil, err
+	}
+	return fromUnstructured(u)
+}
+
+func (c *XdiscoServers) List(ctx context.Context, opts metav1.ListOptions) (*XdiscoServerList, error) {
+	ul, err := c.api.List(ctx, opts)
+	if err != nil {
+		return nil, err
+	}
+	list := &XdiscoServerList{
+		ListMeta: metav1.ListMeta{
+			ResourceVersion: ul.GetResourceVersion(),
+			Continue:        ul.GetContinue(),
+		},
+		Items: make([]XdiscoServer, 0, len(ul.Items)),
+	}
+	for i := range ul.Items {
+		obj, err := fromUnstructured(&ul.Items[i])
+		if err != nil {
+			return nil, err
+		}
+		list.Items = append(list.Items, *obj)
+	}
+	return list, nil
+}
+
+func (c *XdiscoServers) Create(ctx context.Context, obj *XdiscoServer, opts metav1.CreateOptions) (*XdiscoServer, error) {
+	u, err := toUnstructured(obj)
+	if err != nil {
+		return nil, err
+	}
+	u, err = c.api.Create(ctx, u, opts)
+	if err != nil {
+		return nil, err
+	}
+	return fromUnstructured(u)
+}
+
+func (c *XdiscoServers) Update(ctx context.Context, obj *XdiscoServer, opts metav1.UpdateOptions) (*XdiscoServer, error) {
+	u, err := toUnstructured(obj)
+	if err != nil {
+		return nil, err
+	}
+	u, err = c.api.Update(ctx, u, opts)
+	if err != nil {
+		return nil, err
+	}
+	return fromUnstructured(u)
+}
+
+func (c *XdiscoServers) Delete(ctx context.Context, name string, opts metav1.DeleteOptions) error {
+	return c.api.Delete(ctx, name, opts)
+}
+
+// Watch watches the XdiscoServers, the objects of events are converted to *XdiscoServer.
+func (c *XdiscoServers) Watch(ctx context.Context, opts metav1.ListOptions) (watch.Interface, error) {
+	w, err := c.api.Watch(ctx, opts)
+	if err != nil {
+		return nil, err
+	}
+	return watch.Filter(w, func(ev watch.Event) (watch.Event, bool) {
+		if u, ok := ev.Object.(*unstructured.Unstructured); ok {
+			if obj, err := fromUnstructured(u); err == nil {
+				ev.Object = obj
+			}
+		}
+		return ev, true
+	}), nil
+}
+
+func toUnstructured(obj *XdiscoServer) (*unstructured.Unstructured, error) {
+	content, err := runtime.DefaultUnstructuredConverter.ToUnstructured(obj)
+	if err != nil {
+		return nil, err
+	}
+	u := &unstructured.Unstructured{Object: content}
+	u.SetGroupVersionKind(SchemeGroupVersion.WithKind("XdiscoServer"))
+	return u, nil
+}
+
+func fromUnstructured(u *unstructured.Unstructured) (*XdiscoServer, error) {
+	obj := &XdiscoServer{}
+	if err := runtime.DefaultUnstructuredConverter.FromUnstructured(u.UnstructuredContent(), obj); err != nil {
+		return nil, err
+	}
+	return obj, nil
+}
@@ -0,0 +1,6 @@
+// Package v1alpha1 is the v1alpha1 version of the xdisco.io API group,
+// holding the XdiscoServer custom resource and a typed client of it.
+//
+// +k8s:deepcopy-gen=package
+// +groupName=xdisco.io
+package v1alpha1
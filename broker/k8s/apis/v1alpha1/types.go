@@ -0,0 +1,59 @@
+package v1alpha1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// +genclient
+// +k8s:deepcopy-gen:interfaces=k8s.io/apimachinery/pkg/runtime.Object
+
+// XdiscoServer is a server registered in the cluster, by a process or statically for
+// the endpoints out of the cluster, such as VMs and external services.
+type XdiscoServer struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec XdiscoServerSpec `json:"spec"`
+}
+
+// XdiscoServerSpec mirrors server.Server.
+type XdiscoServerSpec struct {
+	ID          string            `json:"id"`
+	Kind        string            `json:"kind"`
+	Host        string            `json:"host"`
+	Ports       map[string]int    `json:"ports,omitempty"`
+	Labels      map[string]string `json:"labels,omitempty"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+	Status      string            `json:"status,omitempty"`
+	Weight      int               `json:"weight,omitempty"`
+	Health      *Health           `json:"health,omitempty"`
+	Load        *Load             `json:"load,omitempty"`
+
+	// identity of the process keeping the server registered, empty for the static ones
+	Holder string `json:"holder,omitempty"`
+	// the server expires if it is not renewed in time, 0 means it never expires
+	LeaseDurationSeconds int32        `json:"leaseDurationSeconds,omitempty"`
+	RenewTime            *metav1.Time `json:"renewTime,omitempty"`
+}
+
+type Health struct {
+	OK     bool   `json:"ok"`
+	Reason string `json:"reason,omitempty"`
+}
+
+// Load is server.Load, with the cpu in millicores as CRDs don't support floats well.
+type Load struct {
+	Connections int   `json:"connections,omitempty"`
+	MilliCPU    int64 `json:"milliCPU,omitempty"`
+	MilliScore  int64 `json:"milliScore,omitempty"`
+}
+
+// +k8s:deepcopy-gen:interfaces=k8s.io/apimachinery/pkg/runtime.Object
+
+// XdiscoServerList is a list of XdiscoServer.
+type XdiscoServerList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+
+	Items []XdiscoServer `json:"items"`
+}
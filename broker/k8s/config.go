@@ -0,0 +1,123 @@
+package k8s
+
+import (
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// AllNamespaces in Options.Namespaces watches the pods of every namespace.
+const AllNamespaces = "*"
+
+// discovery modes of Watch
+const (
+	// watch the pods registered by Start
+	ModePods = "pods"
+	// watch the EndpointSlices of the services, following their readiness
+	ModeEndpointSlices = "endpointslices"
+	// watch the Lease objects registered by RegisterLease
+	ModeLeases = "leases"
+	// watch the XdiscoServer custom resources, registered by RegisterXdiscoServer or statically
+	ModeXdiscoServers = "xdiscoservers"
+)
+
+// registration modes of Start
+const (
+	// register the server on the annotations of the pod itself
+	RegisterPod = "pod"
+	// register the server as a Lease object renewed by the process,
+	// which works for the workloads out of pods and the processes serving several kinds
+	RegisterLease = "lease"
+	// register the server as an XdiscoServer custom resource renewed by the process
+	RegisterXdiscoServer = "xdiscoserver"
+)
+
+type Options struct {
+	// kubeconfig used out of the cluster, default to $KUBECONFIG or ~/.kube/config.
+	// the in-cluster config is used if none of them exists.
+	Kubeconfig string `json:"kubeconfig" toml:"kubeconfig"`
+
+	// context of the kubeconfig, default to its current context
+	Context string `json:"context" toml:"context"`
+
+	// discovery mode of Watch, default to ModePods
+	Mode string `json:"mode" toml:"mode"`
+
+	// registration mode of Start, default to RegisterPod
+	Registration string `json:"registration" toml:"registration"`
+
+	// duration of the Lease objects in RegisterLease and of the XdiscoServers in RegisterXdiscoServer,
+	// they are renewed every third of it
+	LeaseDuration time.Duration `json:"leaseDuration" toml:"leaseDuration"`
+
+	// services watched in ModeEndpointSlices by kind, default to the service named after the kind
+	Services map[string]string `json:"services" toml:"services"`
+
+	// labels required on the pods watched, in addition to kind
+	Selector map[string]string `json:"selector" toml:"selector"`
+
+	// namespaces watched, default to the namespace of the pod itself,
+	// or the namespace of the kubeconfig context out of the cluster.
+	// use AllNamespaces to watch all of them.
+	Namespaces []string `json:"namespaces" toml:"namespaces"`
+
+	// name of the container serving, whose ports are published.
+	// default to the ports of all the containers.
+	MainContainer string `json:"mainContainer" toml:"mainContainer"`
+
+	// interval of replaying the cached pods to the watchers, 0 disables it
+	Resync time.Duration `json:"resync" toml:"resync"`
+
+	// maximum duration of the initial listing of Watch, which fails with the last listing error after it,
+	// e.g. when listing is forbidden to the service account.
+	SyncTimeout time.Duration `json:"syncTimeout" toml:"syncTimeout"`
+}
+
+func DefaultOptions() *Options {
+	return &Options{
+		Mode:          ModePods,
+		Registration:  RegisterPod,
+		LeaseDuration: 15 * time.Second,
+		Resync:        5 * time.Minute,
+		SyncTimeout:   30 * time.Second,
+	}
+}
+
+func (c *Options) WithDefault() *Options {
+	defaultOptions := DefaultOptions()
+	if c.Mode == "" {
+		c.Mode = defaultOptions.Mode
+	}
+	if c.Registration == "" {
+		c.Registration = defaultOptions.Registration
+	}
+	if c.LeaseDuration < time.Second {
+		c.LeaseDuration = defaultOptions.LeaseDuration
+	}
+	if c.SyncTimeout <= 0 {
+		c.SyncTimeout = defaultOptions.SyncTimeout
+	}
+	return c
+}
+
+func (c *Options) serviceOf(kind string) string {
+	if svc, ok := c.Services[kind]; ok && svc != "" {
+		return svc
+	}
+	return kind
+}
+
+// watchNamespaces resolves Namespaces with the default namespace.
+func (c *Options) watchNamespaces(defaultNamespace string) []string {
+	if len(c.Namespaces) <= 0 {
+		return []string{defaultNamespace}
+	}
+	namespaces := make([]string, 0, len(c.Namespaces))
+	for _, ns := range c.Namespaces {
+		if ns == AllNamespaces {
+			return []string{metav1.NamespaceAll}
+		}
+		namespaces = append(namespaces, ns)
+	}
+	return namespaces
+}
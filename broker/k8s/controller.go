@@ -4,228 +4,271 @@ import (
 	"fmt"
 	"os"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/cupen/xdisco/broker"
+	"github.com/cupen/xdisco/broker/k8s/apis/v1alpha1"
 	"github.com/cupen/xdisco/eventhandler"
 	"github.com/cupen/xdisco/server"
 	"go.uber.org/zap"
 	"golang.org/x/net/context"
-	"golang.org/x/time/rate"
 
 	v1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/fields"
 	"k8s.io/apimachinery/pkg/labels"
-	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/apimachinery/pkg/selection"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/informers"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/clientcmd"
 	"k8s.io/client-go/util/retry"
 )
 
+// minimum interval between two updates of the self pod
+const updateInterval = time.Second
+
 // Controller demonstrates how to implement a controller with client-go.
 type Controller struct {
-	client    *kubernetes.Clientset
+	client    kubernetes.Interface
+	crd       *v1alpha1.Client
+	opts      *Options
 	namespace string
-	podMeta   *MyPodMeta
-	watcher   *cache.ListWatch
 
-	selector fields.Selector
-	stateCh  chan server.State
+	// the pod itself, resolved on Start only so watching works out of the cluster.
+	// metaMu guards namespace as well, resolved lazily from the service account.
+	metaMu  sync.Mutex
+	podMeta *MyPodMeta
+
+	mu  sync.Mutex
+	reg *registration
+	// registrations of RegisterLease and RegisterXdiscoServer by object key
+	objects  map[string]*registration
+	identity string
 }
 
 func New(selector map[string]string) (*Controller, error) {
-	slt := fields.SelectorFromSet(selector)
-	c, err := rest.InClusterConfig()
+	opts := DefaultOptions()
+	opts.Selector = selector
+	return NewWithOptions(opts)
+}
+
+// NewWithOptions connects with the kubeconfig of Options, or the in-cluster config if there is none.
+func NewWithOptions(opts *Options) (*Controller, error) {
+	rules := clientcmd.NewDefaultClientConfigLoadingRules()
+	if opts.Kubeconfig != "" {
+		rules.ExplicitPath = opts.Kubeconfig
+	}
+	overrides := &clientcmd.ConfigOverrides{CurrentContext: opts.Context}
+	clientConfig := clientcmd.NewNonInteractiveDeferredLoadingClientConfig(rules, overrides)
+	cfg, err := clientConfig.ClientConfig()
+	if err != nil {
+		return nil, fmt.Errorf("load kubeconfig failed. %w", err)
+	}
+	c, err := NewWithRestConfig(opts, cfg)
 	if err != nil {
 		return nil, err
 	}
-	return NewWithConfig(c, slt)
+	if ns, _, err := clientConfig.Namespace(); err == nil {
+		c.namespace = ns
+	}
+	return c, nil
 }
 
+// NewWithConfig watches the pods matching selector, only the equality requirements are supported.
+// Use NewWithRestConfig for the other options.
 func NewWithConfig(c *rest.Config, selector fields.Selector) (*Controller, error) {
-	clientset, err := kubernetes.NewForConfig(c)
-	if err != nil {
-		return nil, err
+	opts := DefaultOptions()
+	opts.Selector = map[string]string{}
+	if selector != nil {
+		for _, req := range selector.Requirements() {
+			if req.Operator != selection.Equals && req.Operator != selection.DoubleEquals {
+				return nil, fmt.Errorf("unsupported selector: %s", selector)
+			}
+			opts.Selector[req.Field] = req.Value
+		}
 	}
-	cli := clientset.CoreV1().RESTClient()
-	podsWatcher := cache.NewListWatchFromClient(cli, "pods", v1.NamespaceDefault, selector)
-
-	return &Controller{
-		podMeta:  MustGetMyPodMeta(),
-		watcher:  podsWatcher,
-		client:   clientset,
-		selector: selector,
-	}, nil
+	return NewWithRestConfig(opts, c)
 }
 
-func (c *Controller) show(obj interface{}, event string) {
-	key, err := cache.MetaNamespaceKeyFunc(obj)
+// NewWithRestConfig connects with the rest config given rather than the one of Options.
+func NewWithRestConfig(opts *Options, c *rest.Config) (*Controller, error) {
+	clientset, err := kubernetes.NewForConfig(c)
 	if err != nil {
-		log.Warn("[k8s] cache.MetaNamespaceKeyFunc failed", zap.Error(err), zap.Reflect("obj", obj))
-		return
+		return nil, err
 	}
-	p, _ := obj.(*v1.Pod)
-	if p == nil {
-		log.Warn("[k8s] invalid pod object", zap.Reflect("obj", obj))
-		return
+	dyn, err := dynamic.NewForConfig(c)
+	if err != nil {
+		return nil, err
 	}
-	log.Info("[k8s] "+event, zap.String("key", key), zap.Reflect("obj", obj))
+	return NewWithClients(opts, clientset, dyn), nil
 }
 
-func (c *Controller) initWatch() {
-	if c.stateCh != nil {
-		close(c.stateCh)
-	}
-	c.stateCh = make(chan server.State)
+// NewWithClient works without the XdiscoServer custom resources.
+func NewWithClient(opts *Options, client kubernetes.Interface) *Controller {
+	return NewWithClients(opts, client, nil)
 }
-func (c *Controller) startWatch(ctx context.Context, h eventhandler.Handler, hc server.Checker, watchCh watch.Interface) {
-	limiter := rate.NewLimiter(rate.Every(100*time.Millisecond), 10)
-	for {
-		select {
-		case ev := <-watchCh.ResultChan():
-			c.handleEvent(&ev, h, hc)
-			// log.Info("watch event", zap.Reflect("ev", ev), zap.Int("count", count))
-			limiter.Wait(ctx)
-		case <-ctx.Done():
-			log2.Infof("[k8s] watch stopped")
-			return
-		}
+
+// NewWithClients uses the dynamic client for the XdiscoServer custom resources.
+func NewWithClients(opts *Options, client kubernetes.Interface, dyn dynamic.Interface) *Controller {
+	// the defaults are filled in a copy, the options of the caller are left as given.
+	o := *opts
+	c := &Controller{
+		opts:     o.WithDefault(),
+		client:   client,
+		objects:  map[string]*registration{},
+		identity: leaseIdentity(),
+	}
+	if dyn != nil {
+		c.crd = v1alpha1.NewClient(dyn)
 	}
+	return c
 }
 
-func (c *Controller) handleEvent(ev *watch.Event, h eventhandler.Handler, hc server.Checker) error {
-	if ev == nil {
-		return nil
+// Watch watches the pods of kind in the namespaces of Options with shared informers,
+// which relist and rewatch by themselves when the watch expires.
+// In ModeEndpointSlices it watches the EndpointSlices of the service of kind instead,
+// in ModeLeases the Lease objects registered by RegisterLease, and in ModeXdiscoServers the XdiscoServers.
+func (c *Controller) Watch(ctx context.Context, kind string, h eventhandler.Handler, hc server.Checker) error {
+	if !h.IsValid() {
+		panic(fmt.Errorf("invalid eventhandler"))
 	}
-	pod, ok := ev.Object.(*v1.Pod)
-	if !ok {
-		return fmt.Errorf("skip non-pod")
+	switch c.opts.Mode {
+	case ModeEndpointSlices:
+		return c.watchEndpointSlices(ctx, kind, h)
+	case ModeLeases:
+		return c.watchLeases(ctx, kind, h)
+	case ModeXdiscoServers:
+		return c.watchXdiscoServers(ctx, kind, h)
 	}
-	if pod.Status.Phase != v1.PodRunning {
-		log2.Infof("[k8s] skip pod. %s phase:%v", pod.Name, pod.Status.Phase)
-		return nil
+	now := time.Now()
+	labelSelector, err := c.kindSelector(kind)
+	if err != nil {
+		return err
 	}
-	s := podAsServer(pod)
-	if s == nil {
-		log2.Infof("[k8s] invalid pod. %s annotations:%v ", pod.Name, pod.Annotations)
-		return nil
+	w := newPodWatcher(h, c.opts.MainContainer)
+	podInformer := func(ns string) cache.SharedIndexInformer {
+		return c.newFactory(ns, labelSelector).Core().V1().Pods().Informer()
 	}
-	log2.Infof("[k8s] watch event: %s  pod: %s", ev.Type, pod.Name)
-	switch ev.Type {
-	case watch.Added:
-		h.OnAdd(s.GetKey(), s)
-	case watch.Modified:
-		h.OnUpdate(s.GetKey(), s)
-	case watch.Deleted:
-		h.OnDelete(s.GetKey())
-	case watch.Bookmark:
-		log.Info("[k8s] bookmark", zap.Reflect("object", ev.Object))
-	case watch.Error:
-		log.Info("[k8s] error", zap.Reflect("object", ev.Object))
-	default:
-		return nil
+	if _, err := c.runInformers(ctx, podInformer, w.handler()); err != nil {
+		return err
 	}
+	w.init()
+	log2.Infof("[k8s] watch started. cost: %v", time.Since(now))
 	return nil
 }
 
-func (c *Controller) startInformer(ctx context.Context, h eventhandler.Handler, hc server.Checker) error {
-	watcher := c.watcher
-	_, informer := cache.NewIndexerInformer(watcher, &v1.Pod{}, 0, cache.ResourceEventHandlerFuncs{
-		AddFunc: func(obj interface{}) {
-			c.show(obj, "add")
-			if p, ok := obj.(*v1.Pod); ok {
-				s := podAsServer(p)
-				h.OnAdd(s.GetKey(), s)
-			} else {
-				c.show(obj, "add-debug")
-			}
-		},
-		UpdateFunc: func(old interface{}, new interface{}) {
-			c.show(new, "update")
-		},
-		DeleteFunc: func(obj interface{}) {
-			c.show(obj, "delete")
-		},
-	}, cache.Indexers{})
-
-	localStopCh := make(chan struct{}, 8)
-	go informer.Run(localStopCh)
-
-	log.Info("[k8s] watch started.")
-	// Wait for all involved caches to be synced, before processing items from the queue is started
-	if !cache.WaitForCacheSync(localStopCh, informer.HasSynced) {
-		log.Warn("[k8s] watch init failed!!! timed out waiting for sync caches")
-		return fmt.Errorf("init failed")
-	}
-	go func() {
-		<-ctx.Done()
-		localStopCh <- struct{}{}
-	}()
-	return nil
+// Client returns the Kubernetes client of the controller, shared by the components built on it.
+func (c *Controller) Client() kubernetes.Interface {
+	return c.client
 }
 
-func (c *Controller) Watch(ctx context.Context, kind string, h eventhandler.Handler, hc server.Checker) error {
-	if !h.IsValid() {
-		panic(fmt.Errorf("invalid eventhandler"))
-	}
-	now := time.Now()
-	c.initWatch()
-	exprs := c.selector.String()
-	if exprs != "" {
-		exprs += ","
-	}
-	exprs += "kind=" + kind
-	selector, err := labels.Parse(exprs)
+// Identity returns the identity of the process holding the leases of the controller.
+func (c *Controller) Identity() string {
+	return c.identity
+}
+
+// Namespace returns the namespace the controller registers servers in.
+func (c *Controller) Namespace() string {
+	return c.getNameSpace()
+}
+
+// kindSelector returns the label selector of the objects of kind.
+func (c *Controller) kindSelector(kind string) (string, error) {
+	selector := labels.SelectorFromSet(c.opts.Selector)
+	kindReq, err := labels.NewRequirement("kind", selection.Equals, []string{kindLabel(kind)})
 	if err != nil {
-		return fmt.Errorf("invalid label selector: %s", exprs)
+		return "", fmt.Errorf("invalid kind: %s. %w", kind, err)
 	}
-	labelSelector := selector.String()
-	log := log.With(zap.String("selector", labelSelector))
-	podapi := c.client.CoreV1().Pods("default")
-	pods, err := podapi.List(context.TODO(), metav1.ListOptions{LabelSelector: labelSelector})
-	if err != nil {
-		log.Warn("[k8s] list pods failed", zap.Error(err))
-		return err
+	return selector.Add(*kindReq).String(), nil
+}
+
+// newFactory returns a factory of the informers of the objects selected in a namespace.
+func (c *Controller) newFactory(namespace, labelSelector string) informers.SharedInformerFactory {
+	return informers.NewSharedInformerFactoryWithOptions(c.client, c.opts.Resync,
+		informers.WithNamespace(namespace),
+		informers.WithTweakListOptions(func(opts *metav1.ListOptions) {
+			opts.LabelSelector = labelSelector
+		}))
+}
+
+// runInformers runs an informer in each namespace watched until ctx is done,
+// and waits for all of them to be synced within Options.SyncTimeout.
+// The informers are stopped if they fail to sync, with the last listing error.
+func (c *Controller) runInformers(ctx context.Context, informerOf func(namespace string) cache.SharedIndexInformer,
+	h cache.ResourceEventHandler) ([]cache.SharedIndexInformer, error) {
+	namespaces := c.opts.watchNamespaces(c.getNameSpace())
+	log := log.With(zap.Strings("namespaces", namespaces))
+
+	var mu sync.Mutex
+	var lastErr error
+	onWatchError := func(r *cache.Reflector, err error) {
+		mu.Lock()
+		lastErr = err
+		mu.Unlock()
+		cache.DefaultWatchErrorHandler(r, err)
 	}
-	servers := []*server.Server{}
-	for _, pod := range pods.Items {
-		if pod.Status.Phase != v1.PodRunning {
-			log2.Infof("[k8s] skip pod. %s phase:%v", pod.Name, pod.Status.Phase)
-			continue
-		}
-		if s := podAsServer(&pod); s != nil {
-			servers = append(servers, s)
+	stopCh := make(chan struct{})
+	runnings := []cache.SharedIndexInformer{}
+	synced := []cache.InformerSynced{}
+	for _, ns := range namespaces {
+		informer := informerOf(ns)
+		informer.AddEventHandler(h)
+		if err := informer.SetWatchErrorHandler(onWatchError); err != nil {
+			log.Warn("[k8s] set watch error handler failed", zap.Error(err))
 		}
+		runnings = append(runnings, informer)
+		synced = append(synced, informer.HasSynced)
+		go informer.Run(stopCh)
 	}
-	h.OnInit(servers)
-	log.Info("[k8s] pods found", zap.Int("pods", len(pods.Items)), zap.Int("servers", len(servers)))
-	opts := metav1.ListOptions{
-		LabelSelector: labelSelector,
-		Watch:         true,
+	syncCtx, cancel := context.WithTimeout(ctx, c.opts.SyncTimeout)
+	defer cancel()
+	if !cache.WaitForCacheSync(syncCtx.Done(), synced...) {
+		close(stopCh)
+		mu.Lock()
+		err := lastErr
+		mu.Unlock()
+		if err == nil {
+			err = syncCtx.Err()
+		}
+		log.Warn("[k8s] watch init failed!!! timed out waiting for sync caches", zap.Error(err))
+		return nil, fmt.Errorf("watch init failed: %w", err)
 	}
-	watchCh, err := podapi.Watch(ctx, opts)
-	if err != nil {
-		log.Warn("[k8s] list pods failed", zap.Error(err))
-		return err
+	go func() {
+		<-ctx.Done()
+		close(stopCh)
+	}()
+	return runnings, nil
+}
+
+func (c *Controller) getPodMeta() (*MyPodMeta, error) {
+	c.metaMu.Lock()
+	defer c.metaMu.Unlock()
+	if c.podMeta == nil {
+		meta, err := GetMyPodMeta()
+		if err != nil {
+			return nil, fmt.Errorf("unknown self pod, only watching is supported. %w", err)
+		}
+		c.podMeta = meta
 	}
-	go c.startWatch(ctx, h, hc, watchCh)
-	// now := time.Now()
-	// if err := c.startInformer(ctx, h, hc); err != nil {
-	// 	log.Warn("[k8s] watch failed: start informer failed", zap.Error(err))
-	// 	return err
-	// }
-	log2.Infof("[k8s] watch started. cost: %v", time.Since(now))
-	return nil
+	return c.podMeta, nil
 }
 
-// https://kubernetes.io/docs/tasks/inject-data-application/environment-variable-expose-pod-information/
+// getNameSpace returns the namespace watched by default:
+// the namespace of the pod itself, of the kubeconfig context, or of the service account.
 func (c *Controller) getNameSpace() string {
+	if meta, err := c.getPodMeta(); err == nil {
+		return meta.Namespace
+	}
+	c.metaMu.Lock()
+	defer c.metaMu.Unlock()
 	if c.namespace == "" {
 		data, err := os.ReadFile("/var/run/secrets/kubernetes.io/serviceaccount/namespace")
 		if err != nil {
-			panic(fmt.Errorf("failed to get namespace"))
+			return v1.NamespaceDefault
 		}
 		np := string(data)
 		c.namespace = strings.Trim(np, "\n\t ")
@@ -234,7 +277,10 @@ func (c *Controller) getNameSpace() string {
 }
 
 func (c *Controller) getSelfPod(ctx context.Context) (*v1.Pod, error) {
-	meta := c.podMeta
+	meta, err := c.getPodMeta()
+	if err != nil {
+		return nil, err
+	}
 	pod, err := c.client.CoreV1().Pods(meta.Namespace).Get(ctx, meta.Name, metav1.GetOptions{})
 	if err != nil {
 		return nil, fmt.Errorf("getSelfPod faild. %w", err)
@@ -246,8 +292,11 @@ func (c *Controller) getSelfPod(ctx context.Context) (*v1.Pod, error) {
 // 见官方说明：
 // https://github.com/kubernetes/client-go/blob/10e087ca394e2987f09e759438f9949a746c1ca0/examples/create-update-delete-deployment/main.go#L113-L138
 func (c *Controller) updateSelfPod(ctx context.Context, updater func(*v1.Pod) error) error {
+	meta, err := c.getPodMeta()
+	if err != nil {
+		return err
+	}
 	retryErr := retry.RetryOnConflict(retry.DefaultRetry, func() error {
-		meta := c.podMeta
 		podapi := c.client.CoreV1().Pods(meta.Namespace)
 		pod, err := podapi.Get(ctx, meta.Name, metav1.GetOptions{})
 		if err != nil {
@@ -272,57 +321,170 @@ func (c *Controller) newServer(kind string) (*server.Server, error) {
 	if err != nil {
 		return nil, err
 	}
-	// host := pod.Spec.Containers[0].Name
-	// portMeta := pod.Spec.Containers[0].Ports[0]
-	port := pod.Spec.Containers[0].Ports[0].ContainerPort
-	if port <= 0 {
-		return nil, fmt.Errorf("invalid port of container in Pod. podName:%s", pod.ObjectMeta.Name)
+	ports := podPorts(pod, c.opts.MainContainer)
+	if len(ports) <= 0 {
+		return nil, fmt.Errorf("no port of container in Pod. podName:%s container:%s", pod.ObjectMeta.Name, c.opts.MainContainer)
+	}
+	host := pod.Status.PodIP
+	if host == "" {
+		meta, err := c.getPodMeta() // resolved by getSelfPod
+		if err != nil {
+			return nil, err
+		}
+		host = meta.IP
 	}
-
-	meta := c.podMeta
-	// addr := fmt.Sprintf("%s:%d", meta.IP, port)
-	// addr := fmt.Sprintf("%s:%d", pod.Name, port)
 	id := pod.ObjectMeta.Name
-	s := server.NewServer(id, kind, meta.IP)
+	s := server.NewServer(id, kind, host)
 	s.Labels = pod.GetLabels()
-	s.Annotations = pod.GetAnnotations()
-	s.Ports = map[string]int{}
-	for _, p := range pod.Spec.Containers[0].Ports {
-		s.Ports[p.Name] = int(p.ContainerPort)
-	}
+	s.Annotations = podAnnotations(pod)
+	s.Ports = ports
 	return s, nil
 }
 
-func (c *Controller) Start(ctx context.Context, s *server.Server, hooks ...broker.Hook) error {
+func (c *Controller) Start(ctx context.Context, s *server.Server, hooks ...broker.Hook) (broker.Registration, error) {
+	switch c.opts.Registration {
+	case RegisterLease:
+		return c.startLease(ctx, s)
+	case RegisterXdiscoServer:
+		return c.startXdiscoServer(ctx, s)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.reg != nil {
+		return nil, fmt.Errorf("self pod has been registered already. kind:%s", c.reg.Server().Kind)
+	}
 	sn, err := c.newServer(s.Kind)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	sn.Weight = s.Weight
+	sn.Labels = cloneLabels(sn.Labels)
+	for k, v := range s.Labels {
+		sn.Labels[k] = v
+	}
+	for name, value := range s.Annotations {
+		sn.SetAnnotation(name, value)
+	}
 	updater := func(_p *v1.Pod) error {
 		return updatePod(_p, sn)
 	}
 	if err := c.updateSelfPod(ctx, updater); err != nil {
-		return err
+		return nil, err
 	}
 	if !s.IsValid() {
-		return fmt.Errorf("invalid server: %+v", s)
+		return nil, fmt.Errorf("invalid server: %+v", s)
 	}
 	// FIXME: ...
 	*s = *sn
-	go func() {
-		<-ctx.Done()
-		s.Status = string(server.States.Stopping)
-		sn.Status = string(server.States.Stopping)
-		if err := c.updateSelfPod(ctx, updater); err != nil {
-			log.Warn("[k8s] server stopping")
-			log.Warn("[k8s] update pod failed", zap.Error(err))
-		} else {
-			log.Warn("[k8s] server stopping")
+	ctx, cancel := context.WithCancel(ctx)
+	reg := newRegistration(sn, cancel)
+	c.reg = reg
+	go c.keepRegistered(ctx, reg)
+	return reg, nil
+}
+
+func (c *Controller) keepRegistered(ctx context.Context, reg *registration) {
+	defer reg.Close()
+	publish := func(s *server.Server) error {
+		ctx, cancel := context.WithTimeout(context.TODO(), 6*time.Second)
+		defer cancel()
+		updater := func(_p *v1.Pod) error {
+			return updatePod(_p, s)
 		}
-	}()
+		return c.updateSelfPod(ctx, updater)
+	}
+	changed := broker.Coalesce(ctx, reg.Changed(), updateInterval)
+	for {
+		select {
+		case <-changed:
+			if err := publish(reg.Server()); err != nil {
+				log.Warn("[k8s] update pod failed", zap.Error(err))
+			}
+		case req := <-reg.Flushes():
+			err := publish(reg.Server())
+			if err != nil {
+				log.Warn("[k8s] update pod failed", zap.Error(err))
+			}
+			req <- err
+		case <-ctx.Done():
+			c.mu.Lock()
+			if c.reg == reg {
+				c.reg = nil
+			}
+			c.mu.Unlock()
+			// deregistered servers are stopped, the others are going to be.
+			s := reg.Server()
+			if s.GetStatus() != server.States.Stopped {
+				s.SetStatus(server.States.Stopping)
+			}
+			if reg.err = publish(s); reg.err != nil {
+				log.Warn("[k8s] update pod failed", zap.Error(reg.err))
+			}
+			log2.Infof("[k8s] server %s", s.Status)
+			return
+		}
+	}
+}
+
+// Stop marks the self pod as stopped, so watchers drop it right away.
+func (c *Controller) Stop(ctx context.Context, s *server.Server) error {
+	if c.opts.Registration == RegisterLease || c.opts.Registration == RegisterXdiscoServer {
+		key := c.getNameSpace() + "/" + ObjectName(s.Kind, s.ID)
+		c.mu.Lock()
+		reg, ok := c.objects[key]
+		c.mu.Unlock()
+		if !ok {
+			return fmt.Errorf("server not registered. object=%s", key)
+		}
+		if err := reg.Deregister(ctx); err != nil {
+			return err
+		}
+		s.SetStatus(server.States.Stopped)
+		return nil
+	}
+	c.mu.Lock()
+	reg := c.reg
+	c.mu.Unlock()
+	if reg != nil {
+		if err := reg.Deregister(ctx); err != nil {
+			return err
+		}
+		s.SetStatus(server.States.Stopped)
+		return nil
+	}
+	updater := func(_p *v1.Pod) error {
+		setPodStatus(_p, server.States.Stopped)
+		return nil
+	}
+	if err := c.updateSelfPod(ctx, updater); err != nil {
+		return err
+	}
+	s.SetStatus(server.States.Stopped)
+	log.Info("[k8s] server stopped")
 	return nil
 }
 
+func (c *Controller) registrations() []*registration {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	regs := make([]*registration, 0, len(c.objects)+1)
+	if c.reg != nil {
+		regs = append(regs, c.reg)
+	}
+	for _, reg := range c.objects {
+		regs = append(regs, reg)
+	}
+	return regs
+}
+
 func (c *Controller) SetState(state server.State) {
+	for _, reg := range c.registrations() {
+		reg.SetState(state)
+	}
+}
+
+func (c *Controller) SetHealth(ok bool, reason string) {
+	for _, reg := range c.registrations() {
+		reg.SetHealth(ok, reason)
+	}
 }
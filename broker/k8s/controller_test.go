@@ -0,0 +1,83 @@
+package k8s
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/cupen/xdisco/health"
+	"github.com/cupen/xdisco/server"
+	"github.com/stretchr/testify/assert"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/client-go/rest"
+)
+
+func TestStart_SyncPod(t *testing.T) {
+	assert := assert.New(t)
+	self := newPod("ns1", "self", "game")
+	self.Annotations = nil
+	self.Status.PodIP = "10.0.0.1"
+	self.Spec.Containers = []v1.Container{
+		{Name: "app", Ports: []v1.ContainerPort{{Name: "grpc", ContainerPort: 9000}}},
+	}
+	c, client := newTestController(t, DefaultOptions(), self)
+	ctx, cancel := context.WithCancel(context.TODO())
+	defer cancel()
+	evs := newEvents()
+	hc := health.Custom(func(*server.Server) error { return nil })
+	assert.NoError(c.Watch(ctx, "game", evs.handler(), hc))
+
+	s := server.NewServer("self", "game", "")
+	s.SetAnnotation("map", "v1")
+	reg, err := c.Start(ctx, s)
+	if !assert.NoError(err) {
+		return
+	}
+	key := "/k8s//ns1/game/self"
+	assert.Eventually(func() bool { return evs.has("add:" + key) }, waitFor, 10*time.Millisecond)
+	added := evs.get(key)
+	assert.Equal("10.0.0.1:9000", added.PrivateAddress("grpc"))
+	assert.Equal("v1", added.Annotations["map"])
+
+	c.SetState(server.States.Stopping)
+	reg.SetWeight(5)
+	reg.SetLabels(map[string]string{"zone": "a"})
+	reg.SetAnnotation("map", "v2")
+	assert.Eventually(func() bool {
+		s := evs.get(key)
+		return s.GetStatus() == server.States.Stopping && s.Weight == 5 &&
+			s.GetLabel("zone") == "a" && s.Annotations["map"] == "v2"
+	}, waitFor, 10*time.Millisecond)
+	assert.True(evs.has("update:" + key))
+
+	pod, err := client.CoreV1().Pods("ns1").Get(context.TODO(), "self", metav1.GetOptions{})
+	assert.NoError(err)
+	assert.Equal("v2", pod.Annotations["xdisco/v1/map"])
+	assert.Equal("5", pod.Annotations["xdisco/v1/weight"])
+	assert.Equal(`{"zone":"a"}`, pod.Annotations["xdisco/v1/labels"])
+	// labels of the pod are untouched
+	assert.Equal(map[string]string{"kind": "game"}, pod.Labels)
+
+	assert.NoError(reg.Deregister(context.TODO()))
+	assert.Eventually(func() bool { return evs.has("delete:" + key) }, waitFor, 10*time.Millisecond)
+}
+
+func TestNewWithConfig(t *testing.T) {
+	assert := assert.New(t)
+	cfg := &rest.Config{Host: "http://127.0.0.1:1"}
+	c, err := NewWithConfig(cfg, fields.SelectorFromSet(fields.Set{"app": "game"}))
+	assert.NoError(err)
+	assert.Equal(map[string]string{"app": "game"}, c.opts.Selector)
+	assert.Equal(ModePods, c.opts.Mode)
+	_, err = NewWithConfig(cfg, fields.OneTermNotEqualSelector("app", "game"))
+	assert.Error(err)
+
+	// the options of the caller are left as given
+	opts := &Options{}
+	c, err = NewWithRestConfig(opts, cfg)
+	assert.NoError(err)
+	assert.Equal(&Options{}, opts)
+	assert.NotEmpty(c.opts.Mode)
+}
@@ -0,0 +1,195 @@
+package k8s
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cupen/xdisco/eventhandler"
+	"github.com/cupen/xdisco/server"
+	discoveryv1 "k8s.io/api/discovery/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/tools/cache"
+)
+
+// watchEndpointSlices watches the endpoints of the service of kind instead of the pods,
+// so the readiness probes of the pods are respected.
+func (c *Controller) watchEndpointSlices(ctx context.Context, kind string, h eventhandler.Handler) error {
+	now := time.Now()
+	service := c.opts.serviceOf(kind)
+	labelSelector := labels.SelectorFromSet(labels.Set{discoveryv1.LabelServiceName: service}).String()
+	w := newSliceWatcher(kind, h)
+	sliceInformer := func(ns string) cache.SharedIndexInformer {
+		return c.newFactory(ns, labelSelector).Discovery().V1().EndpointSlices().Informer()
+	}
+	if _, err := c.runInformers(ctx, sliceInformer, w.handler()); err != nil {
+		return err
+	}
+	w.init()
+	log2.Infof("[k8s] watch endpointslices started. service: %s cost: %v", service, time.Since(now))
+	return nil
+}
+
+// sliceWatcher translates the EndpointSlice events of informers into server events.
+// An endpoint may show up in several slices of a service while it moves between them,
+// so the servers are published from the union of the slices.
+type sliceWatcher struct {
+	mu     sync.Mutex
+	kind   string
+	h      eventhandler.Handler
+	synced bool
+	// slice key to the servers in the slice
+	slices map[string]map[string]*server.Server
+	// the servers published, server key to server
+	servers map[string]*server.Server
+}
+
+func newSliceWatcher(kind string, h eventhandler.Handler) *sliceWatcher {
+	return &sliceWatcher{
+		kind:    kind,
+		h:       h,
+		slices:  map[string]map[string]*server.Server{},
+		servers: map[string]*server.Server{},
+	}
+}
+
+func (w *sliceWatcher) handler() cache.ResourceEventHandler {
+	return cache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			if slice, ok := obj.(*discoveryv1.EndpointSlice); ok {
+				w.apply(slice)
+			}
+		},
+		UpdateFunc: func(oldObj, newObj interface{}) {
+			if slice, ok := newObj.(*discoveryv1.EndpointSlice); ok {
+				w.apply(slice)
+			}
+		},
+		DeleteFunc: func(obj interface{}) {
+			sliceKey, err := cache.DeletionHandlingMetaNamespaceKeyFunc(obj)
+			if err != nil {
+				log2.Warnf("[k8s] invalid deleted object. err:%v", err)
+				return
+			}
+			w.mu.Lock()
+			defer w.mu.Unlock()
+			delete(w.slices, sliceKey)
+			w.publish()
+		},
+	}
+}
+
+func (w *sliceWatcher) apply(slice *discoveryv1.EndpointSlice) {
+	sliceKey, err := cache.MetaNamespaceKeyFunc(slice)
+	if err != nil {
+		log2.Warnf("[k8s] invalid endpointslice. err:%v", err)
+		return
+	}
+	servers := map[string]*server.Server{}
+	for i := range slice.Endpoints {
+		if s := endpointAsServer(w.kind, slice, &slice.Endpoints[i]); s != nil {
+			servers[s.GetKey()] = s
+		}
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.slices[sliceKey] = servers
+	w.publish()
+}
+
+// publish emits the difference between the union of the slices and the servers published.
+func (w *sliceWatcher) publish() {
+	current := map[string]*server.Server{}
+	for _, servers := range w.slices {
+		for key, s := range servers {
+			// prefer the endpoint serving if it is in several slices.
+			if old, exists := current[key]; !exists || (old.GetStatus().IsStopping() && !s.GetStatus().IsStopping()) {
+				current[key] = s
+			}
+		}
+	}
+	if w.synced {
+		for key, s := range current {
+			old, exists := w.servers[key]
+			switch {
+			case !exists:
+				w.h.OnAdd(key, s)
+			case !reflect.DeepEqual(old, s):
+				w.h.OnUpdate(key, s)
+			}
+		}
+		for key := range w.servers {
+			if _, exists := current[key]; !exists {
+				w.h.OnDelete(key)
+			}
+		}
+	}
+	w.servers = current
+}
+
+func (w *sliceWatcher) init() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	servers := make([]*server.Server, 0, len(w.servers))
+	for _, s := range w.servers {
+		servers = append(servers, s)
+	}
+	w.h.OnInit(servers)
+	w.synced = true
+}
+
+// endpointAsServer maps an endpoint to a server: terminating endpoints are stopping,
+// the others are running, and the ones not ready (or not serving while terminating) are unhealthy.
+func endpointAsServer(kind string, slice *discoveryv1.EndpointSlice, ep *discoveryv1.Endpoint) *server.Server {
+	if len(ep.Addresses) <= 0 {
+		return nil
+	}
+	id := ep.Addresses[0]
+	if ep.TargetRef != nil && ep.TargetRef.Name != "" {
+		id = ep.TargetRef.Name
+	} else if ep.Hostname != nil && *ep.Hostname != "" {
+		id = *ep.Hostname
+	}
+	s := &server.Server{
+		ID:     id,
+		Kind:   kind,
+		Host:   ep.Addresses[0],
+		Ports:  map[string]int{},
+		Labels: slice.GetLabels(),
+	}
+	for _, p := range slice.Ports {
+		if p.Port == nil {
+			continue
+		}
+		name := ""
+		if p.Name != nil {
+			name = *p.Name
+		}
+		s.Ports[name] = int(*p.Port)
+	}
+
+	cond := ep.Conditions
+	ready := cond.Ready == nil || *cond.Ready
+	if cond.Terminating != nil && *cond.Terminating {
+		s.SetStatus(server.States.Stopping)
+		// like Ready, an unset Serving is unknown and taken as serving
+		serving := cond.Serving == nil || *cond.Serving
+		if serving {
+			s.SetHealth(true, "")
+		} else {
+			s.SetHealth(false, "terminating")
+		}
+	} else {
+		s.SetStatus(server.States.Running)
+		if ready {
+			s.SetHealth(true, "")
+		} else {
+			s.SetHealth(false, "not ready")
+		}
+	}
+	key := strings.Join([]string{"/k8s/", slice.Namespace, kind, id}, "/")
+	s.SetKey(key)
+	return s
+}
@@ -0,0 +1,112 @@
+package k8s
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/cupen/xdisco/health"
+	"github.com/cupen/xdisco/server"
+	"github.com/stretchr/testify/assert"
+	v1 "k8s.io/api/core/v1"
+	discoveryv1 "k8s.io/api/discovery/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func newEndpoint(pod, ip string, ready, serving, terminating bool) discoveryv1.Endpoint {
+	return discoveryv1.Endpoint{
+		Addresses: []string{ip},
+		Conditions: discoveryv1.EndpointConditions{
+			Ready:       &ready,
+			Serving:     &serving,
+			Terminating: &terminating,
+		},
+		TargetRef: &v1.ObjectReference{Kind: "Pod", Name: pod},
+	}
+}
+
+func newSlice(namespace, name, service string, endpoints ...discoveryv1.Endpoint) *discoveryv1.EndpointSlice {
+	portName := "grpc"
+	port := int32(9000)
+	return &discoveryv1.EndpointSlice{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: namespace,
+			Name:      name,
+			Labels:    map[string]string{discoveryv1.LabelServiceName: service},
+		},
+		AddressType: discoveryv1.AddressTypeIPv4,
+		Endpoints:   endpoints,
+		Ports:       []discoveryv1.EndpointPort{{Name: &portName, Port: &port}},
+	}
+}
+
+func TestWatch_EndpointSlices(t *testing.T) {
+	assert := assert.New(t)
+	opts := DefaultOptions()
+	opts.Mode = ModeEndpointSlices
+	opts.Services = map[string]string{"game": "game-svc"}
+	c, client := newTestController(t, opts)
+	slices := client.DiscoveryV1().EndpointSlices("ns1")
+	_, err := slices.Create(context.TODO(), newSlice("ns1", "game-svc-1", "game-svc",
+		newEndpoint("a", "10.0.0.1", true, true, false),
+		newEndpoint("b", "10.0.0.2", false, false, false),
+	), metav1.CreateOptions{})
+	assert.NoError(err)
+	_, err = slices.Create(context.TODO(), newSlice("ns1", "other-1", "other",
+		newEndpoint("x", "10.0.0.9", true, true, false),
+	), metav1.CreateOptions{})
+	assert.NoError(err)
+
+	ctx, cancel := context.WithCancel(context.TODO())
+	defer cancel()
+	evs := newEvents()
+	hc := health.Custom(func(*server.Server) error { return nil })
+	assert.NoError(c.Watch(ctx, "game", evs.handler(), hc))
+	assert.ElementsMatch([]string{"init:/k8s//ns1/game/a", "init:/k8s//ns1/game/b"}, evs.list)
+
+	a := evs.get("/k8s//ns1/game/a")
+	assert.Equal("10.0.0.1:9000", a.PrivateAddress("grpc"))
+	assert.Equal(server.States.Running, a.GetStatus())
+	assert.True(a.IsReady())
+	assert.False(evs.get("/k8s//ns1/game/b").IsReady())
+
+	// a is terminating but still serving, b gets ready
+	_, err = slices.Update(context.TODO(), newSlice("ns1", "game-svc-1", "game-svc",
+		newEndpoint("a", "10.0.0.1", false, true, true),
+		newEndpoint("b", "10.0.0.2", true, true, false),
+	), metav1.UpdateOptions{})
+	assert.NoError(err)
+	assert.Eventually(func() bool {
+		a, b := evs.get("/k8s//ns1/game/a"), evs.get("/k8s//ns1/game/b")
+		return a.GetStatus() == server.States.Stopping && b.IsReady()
+	}, waitFor, 10*time.Millisecond)
+
+	// a moves to another slice, not seen as deleted
+	_, err = slices.Create(context.TODO(), newSlice("ns1", "game-svc-2", "game-svc",
+		newEndpoint("a", "10.0.0.1", false, true, true),
+	), metav1.CreateOptions{})
+	assert.NoError(err)
+	_, err = slices.Update(context.TODO(), newSlice("ns1", "game-svc-1", "game-svc",
+		newEndpoint("b", "10.0.0.2", true, true, false),
+	), metav1.UpdateOptions{})
+	assert.NoError(err)
+	assert.NoError(slices.Delete(context.TODO(), "game-svc-1", metav1.DeleteOptions{}))
+	assert.Eventually(func() bool { return evs.has("delete:/k8s//ns1/game/b") }, waitFor, 10*time.Millisecond)
+	assert.False(evs.has("delete:/k8s//ns1/game/a"))
+	assert.NotNil(evs.get("/k8s//ns1/game/a"))
+}
+
+func TestEndpointAsServer_Terminating(t *testing.T) {
+	assert := assert.New(t)
+	slice := newSlice("ns1", "game-svc-1", "game-svc")
+	ep := newEndpoint("a", "10.0.0.1", false, false, true)
+	s := endpointAsServer("game", slice, &ep)
+	assert.Equal(server.States.Stopping, s.GetStatus())
+	assert.False(s.IsReady())
+
+	// Serving is not reported by every cluster, unset means serving
+	ep.Conditions.Serving = nil
+	s = endpointAsServer("game", slice, &ep)
+	assert.Equal(server.States.Stopping, s.GetStatus())
+	assert.True(s.IsReady())
+}
@@ -0,0 +1,232 @@
+package k8s
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/cupen/xdisco/broker"
+	"github.com/cupen/xdisco/eventhandler"
+	"github.com/cupen/xdisco/server"
+	coordinationv1 "k8s.io/api/coordination/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/util/retry"
+)
+
+// ErrDuplicated means the Lease of a server is held by another process.
+var ErrDuplicated = errors.New("server registered by another process")
+
+// annotation of the Lease object holding the server
+const leaseAnnotation = annotation_keyspace + "server"
+
+// maximum length of an object name, a DNS subdomain
+const maxObjectName = 253
+
+// ObjectName returns the name of the object registering a server, a DNS subdomain as Kubernetes requires.
+// The kind and id are lowercased and truncated to fit, a hash of them keeps the names of distinct servers apart.
+func ObjectName(kind, id string) string {
+	return objectName("xdisco-", kind+"-"+id, kind+"\x00"+id, maxObjectName)
+}
+
+// LeaderLeaseName returns the name of the Lease object electing the leader of kind,
+// which never collides with the name of a server.
+func LeaderLeaseName(kind string) string {
+	return objectName("xdisco.election-", kind, kind, maxObjectName)
+}
+
+// kindLabel returns the value of the kind label of the objects registering servers of kind,
+// kind itself if it is a valid label value, or else its readable part with a hash.
+func kindLabel(kind string) string {
+	if len(validation.IsValidLabelValue(kind)) <= 0 {
+		return kind
+	}
+	return objectName("xdisco.", kind, kind, validation.LabelValueMaxLength)
+}
+
+// objectName returns prefix with the readable part of name and a hash of raw, at most maxLen long.
+// The readable part holds lowercase alphanumerics and dashes only.
+func objectName(prefix, name, raw string, maxLen int) string {
+	h := fnv.New32a()
+	h.Write([]byte(raw))
+	suffix := fmt.Sprintf("-%08x", h.Sum32())
+	name = strings.Map(func(r rune) rune {
+		if (r >= 'a' && r <= 'z') || (r >= '0' && r <= '9') {
+			return r
+		}
+		return '-'
+	}, strings.ToLower(name))
+	if n := maxLen - len(prefix) - len(suffix); len(name) > n {
+		name = name[:n]
+	}
+	return prefix + name + suffix
+}
+
+// identity of the process holding the leases
+func leaseIdentity() string {
+	host, _ := os.Hostname()
+	return fmt.Sprintf("%s_%d", host, os.Getpid())
+}
+
+func leaseExpired(lease *coordinationv1.Lease, now time.Time) bool {
+	spec := lease.Spec
+	if spec.RenewTime == nil || spec.LeaseDurationSeconds == nil {
+		return true
+	}
+	expiry := spec.RenewTime.Add(time.Duration(*spec.LeaseDurationSeconds) * time.Second)
+	return now.After(expiry)
+}
+
+// leaseServer returns the server held by the lease, or nil if the lease is expired.
+func leaseServer(lease *coordinationv1.Lease, now time.Time) *server.Server {
+	if leaseExpired(lease, now) {
+		return nil
+	}
+	data, ok := lease.Annotations[leaseAnnotation]
+	if !ok {
+		return nil
+	}
+	s := &server.Server{}
+	if err := json.Unmarshal([]byte(data), s); err != nil {
+		log2.Warnf("[k8s] invalid lease. %s/%s err:%v", lease.Namespace, lease.Name, err)
+		return nil
+	}
+	if !s.IsValid() || s.GetStatus() == server.States.Stopped {
+		return nil
+	}
+	key := strings.Join([]string{"/k8s/", lease.Namespace, s.Kind, s.ID}, "/")
+	s.SetKey(key)
+	return s
+}
+
+// setLease writes s into the lease and renews it.
+func (c *Controller) setLease(lease *coordinationv1.Lease, s *server.Server) error {
+	data, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	labels := map[string]string{}
+	for k, v := range c.opts.Selector {
+		labels[k] = v
+	}
+	labels["kind"] = kindLabel(s.Kind)
+	lease.SetLabels(labels)
+	lease.SetAnnotations(map[string]string{leaseAnnotation: string(data)})
+
+	now := metav1.NewMicroTime(time.Now())
+	duration := int32(c.opts.LeaseDuration / time.Second)
+	if duration < 1 {
+		duration = 1
+	}
+	if lease.Spec.HolderIdentity == nil || *lease.Spec.HolderIdentity != c.identity {
+		lease.Spec.HolderIdentity = &c.identity
+		lease.Spec.AcquireTime = &now
+	}
+	lease.Spec.LeaseDurationSeconds = &duration
+	lease.Spec.RenewTime = &now
+	return nil
+}
+
+// acquireLease creates the lease of s, or takes it over if it is expired or held by the process itself.
+func (c *Controller) acquireLease(ctx context.Context, namespace, name string, s *server.Server) error {
+	leaseapi := c.client.CoordinationV1().Leases(namespace)
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		lease, err := leaseapi.Get(ctx, name, metav1.GetOptions{})
+		if apierrors.IsNotFound(err) {
+			lease = &coordinationv1.Lease{ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: name}}
+			if err := c.setLease(lease, s); err != nil {
+				return err
+			}
+			_, err = leaseapi.Create(ctx, lease, metav1.CreateOptions{})
+			if apierrors.IsAlreadyExists(err) {
+				// created in between, get it again.
+				return apierrors.NewConflict(coordinationv1.Resource("leases"), name, err)
+			}
+			return err
+		}
+		if err != nil {
+			return fmt.Errorf("get lease failed. %w", err)
+		}
+		holder := lease.Spec.HolderIdentity
+		if holder != nil && *holder != c.identity && !leaseExpired(lease, time.Now()) {
+			return fmt.Errorf("%w. lease=%s/%s holder=%s", ErrDuplicated, namespace, name, *holder)
+		}
+		if err := c.setLease(lease, s); err != nil {
+			return err
+		}
+		_, err = leaseapi.Update(ctx, lease, metav1.UpdateOptions{})
+		return err
+	})
+}
+
+func (c *Controller) startLease(ctx context.Context, s *server.Server) (broker.Registration, error) {
+	namespace := c.getNameSpace()
+	name := ObjectName(s.Kind, s.ID)
+	return c.startObject(ctx, namespace, name, s, objectKeeper{
+		acquire: func(ctx context.Context, s *server.Server) error {
+			return c.acquireLease(ctx, namespace, name, s)
+		},
+		release: func(ctx context.Context) error {
+			return c.releaseLease(ctx, namespace, name)
+		},
+	})
+}
+
+// releaseLease deletes the lease unless it has been taken over by another process.
+func (c *Controller) releaseLease(ctx context.Context, namespace, name string) error {
+	leaseapi := c.client.CoordinationV1().Leases(namespace)
+	lease, err := leaseapi.Get(ctx, name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if holder := lease.Spec.HolderIdentity; holder != nil && *holder != c.identity {
+		return nil
+	}
+	err = leaseapi.Delete(ctx, name, metav1.DeleteOptions{
+		Preconditions: &metav1.Preconditions{ResourceVersion: &lease.ResourceVersion},
+	})
+	if apierrors.IsNotFound(err) {
+		return nil
+	}
+	return err
+}
+
+// watchLeases watches the Lease objects of kind, the expired ones are taken as deleted.
+func (c *Controller) watchLeases(ctx context.Context, kind string, h eventhandler.Handler) error {
+	now := time.Now()
+	labelSelector, err := c.kindSelector(kind)
+	if err != nil {
+		return err
+	}
+	w := newWatcher(h, func(obj interface{}) *server.Server {
+		lease, ok := obj.(*coordinationv1.Lease)
+		if !ok {
+			return nil
+		}
+		if s := leaseServer(lease, time.Now()); s != nil && s.Kind == kind {
+			return s
+		}
+		return nil
+	})
+	leaseInformer := func(ns string) cache.SharedIndexInformer {
+		return c.newFactory(ns, labelSelector).Coordination().V1().Leases().Informer()
+	}
+	runnings, err := c.runInformers(ctx, leaseInformer, w.handler())
+	if err != nil {
+		return err
+	}
+	w.init()
+	go c.expire(ctx, runnings, w)
+	log2.Infof("[k8s] watch leases started. cost: %v", time.Since(now))
+	return nil
+}
@@ -0,0 +1,136 @@
+package k8s
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cupen/xdisco/health"
+	"github.com/cupen/xdisco/server"
+	"github.com/stretchr/testify/assert"
+	coordinationv1 "k8s.io/api/coordination/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestLease(t *testing.T) {
+	assert := assert.New(t)
+	opts := DefaultOptions()
+	opts.Mode = ModeLeases
+	opts.Registration = RegisterLease
+	opts.LeaseDuration = 3 * time.Second
+	c, client := newTestController(t, opts)
+	t.Setenv("MY_POD_NAMESPACE", "")
+
+	ctx, cancel := context.WithCancel(context.TODO())
+	defer cancel()
+	evs := newEvents()
+	hc := health.Custom(func(*server.Server) error { return nil })
+	assert.NoError(c.Watch(ctx, "game", evs.handler(), hc))
+
+	// several kinds in a process
+	reg, err := c.Start(ctx, server.NewServer("1", "game", "10.0.0.1"))
+	if !assert.NoError(err) {
+		return
+	}
+	_, err = c.Start(ctx, server.NewServer("1", "gate", "10.0.0.1"))
+	assert.NoError(err)
+	key := "/k8s//default/game/1"
+	assert.Eventually(func() bool { return evs.has("add:" + key) }, waitFor, 10*time.Millisecond)
+	assert.False(evs.has("add:/k8s//default/gate/1"))
+
+	lease, err := client.CoordinationV1().Leases("default").Get(context.TODO(), ObjectName("game", "1"), metav1.GetOptions{})
+	assert.NoError(err)
+	assert.Equal(c.identity, *lease.Spec.HolderIdentity)
+	assert.Equal(int32(3), *lease.Spec.LeaseDurationSeconds)
+
+	// registered already, by the process itself or by another one
+	_, err = c.Start(ctx, server.NewServer("1", "game", "10.0.0.1"))
+	assert.ErrorIs(err, ErrDuplicated)
+	other := NewWithClient(opts, client)
+	other.identity = "other"
+	_, err = other.Start(ctx, server.NewServer("1", "game", "10.0.0.2"))
+	assert.ErrorIs(err, ErrDuplicated)
+
+	reg.SetState(server.States.Stopping)
+	assert.Eventually(func() bool {
+		s := evs.get(key)
+		return s != nil && s.GetStatus() == server.States.Stopping
+	}, waitFor, 10*time.Millisecond)
+
+	assert.NoError(reg.Deregister(context.TODO()))
+	assert.Eventually(func() bool { return evs.has("delete:" + key) }, waitFor, 10*time.Millisecond)
+}
+
+func TestLease_Expired(t *testing.T) {
+	assert := assert.New(t)
+	opts := DefaultOptions()
+	opts.Registration = RegisterLease
+	c, client := newTestController(t, opts)
+
+	// left by a process gone
+	holder := "gone"
+	duration := int32(10)
+	renewed := metav1.NewMicroTime(time.Now().Add(-time.Minute))
+	lease := &coordinationv1.Lease{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "ns1", Name: ObjectName("game", "1")},
+		Spec: coordinationv1.LeaseSpec{
+			HolderIdentity:       &holder,
+			LeaseDurationSeconds: &duration,
+			RenewTime:            &renewed,
+		},
+	}
+	_, err := client.CoordinationV1().Leases("ns1").Create(context.TODO(), lease, metav1.CreateOptions{})
+	assert.NoError(err)
+	assert.Nil(leaseServer(lease, time.Now()))
+
+	reg, err := c.Start(context.TODO(), server.NewServer("1", "game", "10.0.0.1"))
+	if !assert.NoError(err) {
+		return
+	}
+	defer reg.Deregister(context.TODO())
+	lease, err = client.CoordinationV1().Leases("ns1").Get(context.TODO(), ObjectName("game", "1"), metav1.GetOptions{})
+	assert.NoError(err)
+	assert.Equal(c.identity, *lease.Spec.HolderIdentity)
+	s := leaseServer(lease, time.Now())
+	if assert.NotNil(s) {
+		assert.Equal("10.0.0.1", s.Host)
+	}
+	assert.Nil(leaseServer(lease, time.Now().Add(time.Minute)))
+}
+
+func TestObjectName(t *testing.T) {
+	assert := assert.New(t)
+	assert.Regexp(`^xdisco-game-1-[0-9a-f]{8}$`, ObjectName("game", "1"))
+	assert.Equal(ObjectName("game", "1"), ObjectName("game", "1"))
+
+	// normalized alike, still distinct
+	assert.NotEqual(ObjectName("Game", "1"), ObjectName("game", "1"))
+	assert.NotEqual(ObjectName("game", "a_b"), ObjectName("game", "a-b"))
+	assert.NotEqual(ObjectName("game-a", "1"), ObjectName("game", "a-1"))
+	assert.NotEqual(LeaderLeaseName("game"), ObjectName("election", "game"))
+
+	long := ObjectName("game", strings.Repeat("x", 300))
+	assert.Len(long, maxObjectName)
+	assert.NotEqual(long, ObjectName("game", strings.Repeat("x", 301)))
+	assert.Regexp(`^[a-z0-9]([-a-z0-9]*[a-z0-9])?(\.[a-z0-9]([-a-z0-9]*[a-z0-9])?)*$`, LeaderLeaseName("Sched.uler"))
+}
+
+func TestKindLabel(t *testing.T) {
+	assert := assert.New(t)
+	c := NewWithClient(DefaultOptions(), fake.NewSimpleClientset())
+	for _, kind := range []string{"game", "a/b c", strings.Repeat("k", 100)} {
+		value := kindLabel(kind)
+		assert.Empty(validation.IsValidLabelValue(value), kind)
+		selector, err := c.kindSelector(kind)
+		assert.NoError(err, kind)
+		parsed, err := labels.Parse(selector)
+		assert.NoError(err)
+		assert.True(parsed.Matches(labels.Set{"kind": value}), kind)
+	}
+	assert.Equal("game", kindLabel("game"))
+	assert.NotEqual(kindLabel("a/b"), kindLabel("a b"))
+}
@@ -1,7 +1,9 @@
 package k8s
 
 import (
+	"encoding/json"
 	"fmt"
+	"strconv"
 	"strings"
 	"time"
 
@@ -13,23 +15,110 @@ const (
 	annotation_keyspace = "xdisco/v1/"
 )
 
+// names of the annotations written by the broker itself, the custom annotations of servers can't use them.
+var reservedAnnotations = map[string]bool{
+	"kind":          true,
+	"status":        true,
+	"weight":        true,
+	"labels":        true,
+	"health":        true,
+	"health.reason": true,
+	"load":          true,
+}
+
 func updatePod(pod *v1.Pod, s *server.Server) error {
-	port := pod.Spec.Containers[0].Ports[0].ContainerPort
-	if port <= 0 {
-		return fmt.Errorf("invalid port of container in Pod. podName:%s", pod.ObjectMeta.Name)
+	if len(s.Ports) <= 0 {
+		return fmt.Errorf("no port of container in Pod. podName:%s", pod.ObjectMeta.Name)
 	}
 	attrs := pod.GetAnnotations()
 	if attrs == nil {
 		attrs = map[string]string{}
 	}
 	keyspace := annotation_keyspace
+	// the annotations under the keyspace are owned by xdisco, the ones gone from the server are dropped.
+	for k := range attrs {
+		if strings.HasPrefix(k, keyspace) {
+			delete(attrs, k)
+		}
+	}
 	attrs[keyspace+"kind"] = s.Kind
 	attrs[keyspace+"status"] = s.Status
+	attrs[keyspace+"weight"] = strconv.Itoa(s.Weight)
+	for name, value := range s.Annotations {
+		if reservedAnnotations[name] {
+			continue
+		}
+		attrs[keyspace+name] = value
+	}
+	// labels of the pod are left to its owner, the ones added by the server are kept aside.
+	labels := map[string]string{}
+	for k, v := range s.Labels {
+		if pod.Labels[k] != v {
+			labels[k] = v
+		}
+	}
+	if len(labels) > 0 {
+		data, err := json.Marshal(labels)
+		if err != nil {
+			return err
+		}
+		attrs[keyspace+"labels"] = string(data)
+	}
 	pod.SetAnnotations(attrs)
+	if s.Health != nil {
+		setPodHealth(pod, s.Health)
+	}
+	if s.Load != nil {
+		data, err := json.Marshal(s.Load)
+		if err != nil {
+			return err
+		}
+		attrs[keyspace+"load"] = string(data)
+	}
 	return nil
 }
 
-func podAsServer(pod *v1.Pod) *server.Server {
+func setPodStatus(pod *v1.Pod, state server.State) {
+	attrs := pod.GetAnnotations()
+	if attrs == nil {
+		attrs = map[string]string{}
+	}
+	attrs[annotation_keyspace+"status"] = string(state)
+	pod.SetAnnotations(attrs)
+}
+
+func setPodHealth(pod *v1.Pod, h *server.Health) {
+	attrs := pod.GetAnnotations()
+	if attrs == nil {
+		attrs = map[string]string{}
+	}
+	keyspace := annotation_keyspace
+	attrs[keyspace+"health"] = strconv.FormatBool(h.OK)
+	attrs[keyspace+"health.reason"] = h.Reason
+	pod.SetAnnotations(attrs)
+}
+
+// podPorts returns the named ports of the main container,
+// or of all the containers if main is empty, the first one wins on conflicting names.
+func podPorts(pod *v1.Pod, main string) map[string]int {
+	ports := map[string]int{}
+	for _, c := range pod.Spec.Containers {
+		if main != "" && c.Name != main {
+			continue
+		}
+		for _, p := range c.Ports {
+			if p.ContainerPort <= 0 {
+				continue
+			}
+			if _, exists := ports[p.Name]; !exists {
+				ports[p.Name] = int(p.ContainerPort)
+			}
+		}
+	}
+	return ports
+}
+
+func podAsServer(pod *v1.Pod, mainContainer string) *server.Server {
 	annotations := pod.GetAnnotations()
 	annotationsCleaned := map[string]string{}
 	for k, v := range annotations {
@@ -41,12 +130,36 @@ func podAsServer(pod *v1.Pod) *server.Server {
 	s := &server.Server{
 		ID:          pod.ObjectMeta.Name,
 		Kind:        annotationsCleaned["kind"],
+		Host:        pod.Status.PodIP,
+		Ports:       podPorts(pod, mainContainer),
 		Status:      annotationsCleaned["status"],
 		Annotations: annotationsCleaned,
 		Labels:      pod.GetLabels(),
 		CreatedAt:   pod.CreationTimestamp.Time,
 		UpdatedAt:   time.Now(),
 	}
+	if v, ok := annotationsCleaned["weight"]; ok {
+		s.Weight, _ = strconv.Atoi(v)
+	}
+	if v, ok := annotationsCleaned["labels"]; ok {
+		labels := map[string]string{}
+		if err := json.Unmarshal([]byte(v), &labels); err == nil {
+			s.Labels = cloneLabels(s.Labels)
+			for k, v := range labels {
+				s.Labels[k] = v
+			}
+		}
+	}
+	if v, ok := annotationsCleaned["health"]; ok {
+		healthy, _ := strconv.ParseBool(v)
+		s.SetHealth(healthy, annotationsCleaned["health.reason"])
+	}
+	if v, ok := annotationsCleaned["load"]; ok {
+		load := server.Load{}
+		if err := json.Unmarshal([]byte(v), &load); err == nil {
+			s.SetLoad(load)
+		}
+	}
 	if !s.IsValid() {
 		return nil
 	}
@@ -54,3 +167,24 @@ func podAsServer(pod *v1.Pod) *server.Server {
 	s.SetKey(key)
 	return s
 }
+
+func cloneLabels(labels map[string]string) map[string]string {
+	rs := make(map[string]string, len(labels))
+	for k, v := range labels {
+		rs[k] = v
+	}
+	return rs
+}
+
+// podAnnotations returns the custom annotations of the server written on the pod.
+func podAnnotations(pod *v1.Pod) map[string]string {
+	rs := map[string]string{}
+	for k, v := range pod.GetAnnotations() {
+		name := strings.TrimPrefix(k, annotation_keyspace)
+		if name == k || reservedAnnotations[name] {
+			continue
+		}
+		rs[name] = v
+	}
+	return rs
+}
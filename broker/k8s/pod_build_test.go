@@ -3,26 +3,60 @@ package k8s
 import (
 	"testing"
 
+	"github.com/cupen/xdisco/server"
 	"github.com/stretchr/testify/assert"
 	v1 "k8s.io/api/core/v1"
 )
 
 func TestPod(t *testing.T) {
 	assert := assert.New(t)
-	assert.Equal(0, 1)
 
 	pod := &v1.Pod{}
+	pod.SetName("pod-1")
 	pod.SetAnnotations(map[string]string{
-		"xdisco/v1/addr":   "127.0.0.1:11",
 		"xdisco/v1/kind":   "test",
 		"xdisco/v1/status": "yes",
 	})
-	s := podAsServer(pod)
-	assert.Equal(s.Addr, "127.0.0.1:11")
-	assert.Equal(s.Kind, "test")
-	assert.Equal(s.Status, "yes")
+	pod.Status.PodIP = "10.0.0.1"
+	pod.Spec.Containers = []v1.Container{
+		{Name: "app", Ports: []v1.ContainerPort{{Name: "grpc", ContainerPort: 9000}, {Name: "http", ContainerPort: 8080}}},
+		{Name: "sidecar", Ports: []v1.ContainerPort{{Name: "http", ContainerPort: 15000}, {Name: "admin", ContainerPort: 15001}}},
+	}
+	s := podAsServer(pod, "")
+	assert.Equal("test", s.Kind)
+	assert.Equal("yes", s.Status)
+	assert.Equal("10.0.0.1", s.Host)
+	assert.Equal(map[string]int{"grpc": 9000, "http": 8080, "admin": 15001}, s.Ports)
+	assert.Equal("10.0.0.1:9000", s.PrivateAddress("grpc"))
 
 	assert.Equal(s.Annotations["kind"], "test")
 	assert.Equal(s.Annotations["status"], "yes")
-	assert.Equal(s.Annotations["addr"], "127.0.0.1:11")
+
+	// only the ports of the main container
+	s = podAsServer(pod, "sidecar")
+	assert.Equal(map[string]int{"http": 15000, "admin": 15001}, s.Ports)
+	assert.Equal("10.0.0.1:15000", s.PrivateAddress("http"))
+}
+
+func TestUpdatePod(t *testing.T) {
+	assert := assert.New(t)
+	pod := &v1.Pod{}
+	pod.SetName("pod-1")
+	pod.SetAnnotations(map[string]string{"owner/note": "kept"})
+	s := server.NewServer("pod-1", "test", "10.0.0.1")
+	s.Ports["grpc"] = 9000
+	s.SetAnnotation("partitions", "1,2")
+	s.SetLoad(server.Load{Connections: 3})
+	assert.NoError(updatePod(pod, s))
+	assert.Equal("1,2", pod.Annotations["xdisco/v1/partitions"])
+	assert.Contains(pod.Annotations, "xdisco/v1/load")
+
+	// the annotations gone from the server are dropped, the ones of others are kept
+	delete(s.Annotations, "partitions")
+	s.Load = nil
+	assert.NoError(updatePod(pod, s))
+	assert.NotContains(pod.Annotations, "xdisco/v1/partitions")
+	assert.NotContains(pod.Annotations, "xdisco/v1/load")
+	assert.Equal("kept", pod.Annotations["owner/note"])
+	assert.Equal("test", pod.Annotations["xdisco/v1/kind"])
 }
@@ -19,22 +19,32 @@ func getenv(key string) (string, error) {
 	return value, nil
 }
 
-func MustGetMyPodMeta() *MyPodMeta {
+// GetMyPodMeta returns the metadata of the pod itself exposed through environment variables.
+// https://kubernetes.io/docs/tasks/inject-data-application/environment-variable-expose-pod-information/
+func GetMyPodMeta() (*MyPodMeta, error) {
 	name, err := getenv("MY_POD_NAME")
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
 	namespace, err := getenv("MY_POD_NAMESPACE")
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
 	ip, err := getenv("MY_POD_IP")
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
 	return &MyPodMeta{
 		Name:      name,
 		Namespace: namespace,
 		IP:        ip,
+	}, nil
+}
+
+func MustGetMyPodMeta() *MyPodMeta {
+	meta, err := GetMyPodMeta()
+	if err != nil {
+		panic(err)
 	}
+	return meta
 }
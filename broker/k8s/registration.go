@@ -0,0 +1,127 @@
+package k8s
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/cupen/xdisco/broker"
+	"github.com/cupen/xdisco/server"
+	"go.uber.org/zap"
+	"k8s.io/client-go/tools/cache"
+)
+
+type registration struct {
+	*broker.Record
+	cancel context.CancelFunc
+	err    error // result of the deregistration, valid after Done
+}
+
+func newRegistration(s *server.Server, cancel context.CancelFunc) *registration {
+	return &registration{
+		Record: broker.NewRecord(s),
+		cancel: cancel,
+	}
+}
+
+func (r *registration) Deregister(ctx context.Context) error {
+	r.SetState(server.States.Stopped)
+	r.cancel()
+	select {
+	case <-r.Done():
+		return r.err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// objectKeeper keeps a server registered as an object renewed by the process, a Lease or an XdiscoServer.
+type objectKeeper struct {
+	// creates or renews the object of the server, taking over the expired one of another process
+	acquire func(context.Context, *server.Server) error
+	// deletes the object unless it has been taken over by another process
+	release func(context.Context) error
+}
+
+func (c *Controller) startObject(ctx context.Context, namespace, name string, s *server.Server, keeper objectKeeper) (broker.Registration, error) {
+	if !s.IsValid() {
+		return nil, fmt.Errorf("invalid server: %+v", s)
+	}
+	key := namespace + "/" + name
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, exists := c.objects[key]; exists {
+		return nil, fmt.Errorf("%w. object=%s", ErrDuplicated, key)
+	}
+	s.SetStatus(server.States.Running)
+	if err := keeper.acquire(ctx, s); err != nil {
+		log.Warn("[k8s] server start failed!!!", zap.String("object", key), zap.Error(err))
+		return nil, err
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	reg := newRegistration(s, cancel)
+	c.objects[key] = reg
+	go c.keepObject(ctx, key, reg, keeper)
+	log.Info("[k8s] server started", zap.String("object", key))
+	return reg, nil
+}
+
+func (c *Controller) keepObject(ctx context.Context, key string, reg *registration, keeper objectKeeper) {
+	defer reg.Close()
+	publish := func() error {
+		ctx, cancel := context.WithTimeout(context.TODO(), 6*time.Second)
+		defer cancel()
+		err := keeper.acquire(ctx, reg.Server())
+		if err != nil {
+			log.Warn("[k8s] renew object failed", zap.String("object", key), zap.Error(err))
+		}
+		return err
+	}
+	renew := time.NewTicker(c.opts.LeaseDuration / 3)
+	defer renew.Stop()
+	changed := broker.Coalesce(ctx, reg.Changed(), updateInterval)
+	for {
+		select {
+		case <-renew.C:
+			publish()
+		case <-changed:
+			publish()
+		case req := <-reg.Flushes():
+			req <- publish()
+		case <-ctx.Done():
+			c.mu.Lock()
+			if c.objects[key] == reg {
+				delete(c.objects, key)
+			}
+			c.mu.Unlock()
+			ctx, cancel := context.WithTimeout(context.TODO(), 6*time.Second)
+			err := keeper.release(ctx)
+			cancel()
+			if err != nil {
+				reg.err = err
+				log.Warn("[k8s] delete object failed", zap.String("object", key), zap.Error(err))
+			}
+			log.Info("[k8s] server stopped", zap.String("object", key))
+			return
+		}
+	}
+}
+
+// expire applies the cached objects again from time to time until ctx is done,
+// as the objects renewed by processes expire without any event.
+func (c *Controller) expire(ctx context.Context, runnings []cache.SharedIndexInformer, w *watcher) {
+	ticker := time.NewTicker(c.opts.LeaseDuration / 3)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			for _, informer := range runnings {
+				for _, obj := range informer.GetStore().List() {
+					w.apply(obj)
+				}
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,162 @@
+package k8s
+
+import (
+	"reflect"
+	"sync"
+
+	"github.com/cupen/xdisco/eventhandler"
+	"github.com/cupen/xdisco/server"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+// watcher translates the events of informers into server events, objects are mapped to servers by serverOf.
+// Events are held back until every informer is synced, the objects cached by then are passed to OnInit.
+type watcher struct {
+	mu       sync.Mutex
+	h        eventhandler.Handler
+	serverOf func(obj interface{}) *server.Server
+	synced   bool
+	// the objects serving, object key to server
+	servers map[string]*server.Server
+}
+
+func newWatcher(h eventhandler.Handler, serverOf func(obj interface{}) *server.Server) *watcher {
+	return &watcher{
+		h:        h,
+		serverOf: serverOf,
+		servers:  map[string]*server.Server{},
+	}
+}
+
+func newPodWatcher(h eventhandler.Handler, mainContainer string) *watcher {
+	return newWatcher(h, func(obj interface{}) *server.Server {
+		pod, ok := obj.(*v1.Pod)
+		if !ok {
+			return nil
+		}
+		return podServer(pod, mainContainer)
+	})
+}
+
+// podServer returns the server registered by the pod, or nil if it is not serving.
+// The pods outlive their servers, so a stopped server is taken as deregistered.
+// Pods failing readiness are not serving either, and terminating pods are stopping.
+func podServer(pod *v1.Pod, mainContainer string) *server.Server {
+	if pod.Status.Phase != v1.PodRunning || !podReady(pod, mainContainer) {
+		return nil
+	}
+	s := podAsServer(pod, mainContainer)
+	if s == nil || s.GetStatus() == server.States.Stopped {
+		return nil
+	}
+	if pod.DeletionTimestamp != nil {
+		s.SetStatus(server.States.Stopping)
+	}
+	return s
+}
+
+// podReady reports the readiness of the main container, or of the pod if there is no main container.
+func podReady(pod *v1.Pod, mainContainer string) bool {
+	if mainContainer != "" {
+		for _, cs := range pod.Status.ContainerStatuses {
+			if cs.Name == mainContainer {
+				return cs.Ready
+			}
+		}
+		return false
+	}
+	for _, cond := range pod.Status.Conditions {
+		if cond.Type == v1.PodReady {
+			return cond.Status == v1.ConditionTrue
+		}
+	}
+	return false
+}
+
+func (w *watcher) handler() cache.ResourceEventHandler {
+	return cache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			w.apply(obj)
+		},
+		UpdateFunc: func(oldObj, newObj interface{}) {
+			w.apply(newObj)
+		},
+		DeleteFunc: func(obj interface{}) {
+			// the object is a tombstone if its deletion was missed while the watch was broken.
+			objKey, err := cache.DeletionHandlingMetaNamespaceKeyFunc(obj)
+			if err != nil {
+				log2.Warnf("[k8s] invalid deleted object. err:%v", err)
+				return
+			}
+			w.remove(objKey)
+		},
+	}
+}
+
+// apply publishes the change of an object, an object stops serving is published as deleted.
+func (w *watcher) apply(obj interface{}) {
+	objKey, err := cache.MetaNamespaceKeyFunc(obj)
+	if err != nil {
+		log2.Warnf("[k8s] invalid object. err:%v", err)
+		return
+	}
+	s := w.serverOf(obj)
+	if s == nil {
+		w.remove(objKey)
+		return
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	old, exists := w.servers[objKey]
+	// replayed by resync, or changes of the pod not related to the server.
+	if exists && sameServer(old, s) {
+		return
+	}
+	w.servers[objKey] = s
+	if !w.synced {
+		return
+	}
+	switch {
+	case !exists:
+		w.h.OnAdd(s.GetKey(), s)
+	case old.GetKey() != s.GetKey():
+		// the kind of the pod changed.
+		w.h.OnDelete(old.GetKey())
+		w.h.OnAdd(s.GetKey(), s)
+	default:
+		w.h.OnUpdate(s.GetKey(), s)
+	}
+}
+
+func (w *watcher) remove(objKey string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	old, exists := w.servers[objKey]
+	if !exists {
+		return
+	}
+	delete(w.servers, objKey)
+	if w.synced {
+		w.h.OnDelete(old.GetKey())
+	}
+}
+
+// init passes the servers cached so far to OnInit and starts publishing events.
+func (w *watcher) init() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	servers := make([]*server.Server, 0, len(w.servers))
+	for _, s := range w.servers {
+		servers = append(servers, s)
+	}
+	w.h.OnInit(servers)
+	w.synced = true
+}
+
+// sameServer reports whether a and b differ in nothing but updatedAt.
+func sameServer(a, b *server.Server) bool {
+	c := *b
+	c.UpdatedAt = a.UpdatedAt
+	return reflect.DeepEqual(a, &c)
+}
@@ -0,0 +1,279 @@
+package k8s
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cupen/xdisco/eventhandler"
+	"github.com/cupen/xdisco/health"
+	"github.com/cupen/xdisco/server"
+	"github.com/stretchr/testify/assert"
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+	"k8s.io/client-go/tools/cache"
+)
+
+type events struct {
+	mu      sync.Mutex
+	list    []string
+	servers map[string]*server.Server
+}
+
+func newEvents() *events {
+	return &events{servers: map[string]*server.Server{}}
+}
+
+func (e *events) add(ev string, key string, s *server.Server) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.list = append(e.list, ev+":"+key)
+	if s != nil {
+		e.servers[key] = s
+	} else {
+		delete(e.servers, key)
+	}
+}
+
+func (e *events) has(ev string) bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	for _, v := range e.list {
+		if v == ev {
+			return true
+		}
+	}
+	return false
+}
+
+func (e *events) get(key string) *server.Server {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.servers[key]
+}
+
+func (e *events) handler() eventhandler.Handler {
+	return eventhandler.Handler{
+		OnInit: func(servers []*server.Server) {
+			for _, s := range servers {
+				e.add("init", s.GetKey(), s)
+			}
+		},
+		OnAdd:    func(key string, s *server.Server) { e.add("add", key, s) },
+		OnUpdate: func(key string, s *server.Server) { e.add("update", key, s) },
+		OnDelete: func(key string) { e.add("delete", key, nil) },
+	}
+}
+
+func newPod(namespace, name, kind string) *v1.Pod {
+	pod := &v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: namespace,
+			Name:      name,
+			Labels:    map[string]string{"kind": kind},
+			Annotations: map[string]string{
+				annotation_keyspace + "kind":   kind,
+				annotation_keyspace + "status": string(server.States.Running),
+			},
+		},
+		Status: v1.PodStatus{
+			Phase:      v1.PodRunning,
+			Conditions: []v1.PodCondition{{Type: v1.PodReady, Status: v1.ConditionTrue}},
+		},
+	}
+	return pod
+}
+
+func newTestController(t *testing.T, opts *Options, objs ...*v1.Pod) (*Controller, *fake.Clientset) {
+	t.Setenv("MY_POD_NAME", "self")
+	t.Setenv("MY_POD_NAMESPACE", "ns1")
+	t.Setenv("MY_POD_IP", "127.0.0.1")
+	client := fake.NewSimpleClientset()
+	for _, obj := range objs {
+		if _, err := client.CoreV1().Pods(obj.Namespace).Create(context.TODO(), obj, metav1.CreateOptions{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return NewWithClient(opts, client), client
+}
+
+const waitFor = 3 * time.Second
+
+func TestWatch(t *testing.T) {
+	assert := assert.New(t)
+	opts := DefaultOptions()
+	opts.Namespaces = []string{"ns1", "ns2"}
+	c, client := newTestController(t, opts,
+		newPod("ns1", "a", "game"),
+		newPod("ns2", "b", "game"),
+		newPod("ns3", "c", "game"),
+		newPod("ns1", "d", "gate"),
+	)
+	ctx, cancel := context.WithCancel(context.TODO())
+	defer cancel()
+	evs := newEvents()
+	hc := health.Custom(func(*server.Server) error { return nil })
+	assert.NoError(c.Watch(ctx, "game", evs.handler(), hc))
+	assert.ElementsMatch([]string{"init:/k8s//ns1/game/a", "init:/k8s//ns2/game/b"}, evs.list)
+
+	pods := client.CoreV1().Pods("ns2")
+	_, err := pods.Create(context.TODO(), newPod("ns2", "e", "game"), metav1.CreateOptions{})
+	assert.NoError(err)
+	assert.Eventually(func() bool { return evs.has("add:/k8s//ns2/game/e") }, waitFor, 10*time.Millisecond)
+
+	// a pod stops running is deleted
+	pod := newPod("ns2", "e", "game")
+	pod.ResourceVersion = "2"
+	pod.Status.Phase = v1.PodFailed
+	_, err = pods.Update(context.TODO(), pod, metav1.UpdateOptions{})
+	assert.NoError(err)
+	assert.Eventually(func() bool { return evs.has("delete:/k8s//ns2/game/e") }, waitFor, 10*time.Millisecond)
+
+	assert.NoError(pods.Delete(context.TODO(), "b", metav1.DeleteOptions{}))
+	assert.Eventually(func() bool { return evs.has("delete:/k8s//ns2/game/b") }, waitFor, 10*time.Millisecond)
+}
+
+func TestWatch_ListForbidden(t *testing.T) {
+	assert := assert.New(t)
+	opts := DefaultOptions()
+	opts.SyncTimeout = 300 * time.Millisecond
+	c, client := newTestController(t, opts)
+	client.PrependReactor("list", "pods", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		return true, nil, apierrors.NewForbidden(v1.Resource("pods"), "", errors.New("no rbac"))
+	})
+	hc := health.Custom(func(*server.Server) error { return nil })
+	err := c.Watch(context.TODO(), "game", newEvents().handler(), hc)
+	if assert.Error(err) {
+		assert.Contains(err.Error(), "forbidden")
+	}
+}
+
+func TestWatcher_Tombstone(t *testing.T) {
+	assert := assert.New(t)
+	evs := newEvents()
+	w := newPodWatcher(evs.handler(), "")
+	h := w.handler()
+	pod := newPod("ns1", "a", "game")
+	h.OnAdd(pod)
+	w.init()
+	assert.Equal([]string{"init:/k8s//ns1/game/a"}, evs.list)
+
+	// resync replays the pod unchanged
+	h.OnUpdate(pod, pod)
+	assert.Len(evs.list, 1)
+
+	// the deletion was missed by a broken watch
+	h.OnDelete(cache.DeletedFinalStateUnknown{Key: "ns1/a", Obj: pod})
+	assert.True(evs.has("delete:/k8s//ns1/game/a"))
+
+	// unknown pods are not deleted
+	h.OnDelete(cache.DeletedFinalStateUnknown{Key: "ns1/x"})
+	assert.Len(evs.list, 2)
+}
+
+func TestWatcher_Readiness(t *testing.T) {
+	assert := assert.New(t)
+	evs := newEvents()
+	w := newPodWatcher(evs.handler(), "app")
+	h := w.handler()
+	key := "/k8s//ns1/game/a"
+	pod := newPod("ns1", "a", "game")
+	pod.Status.ContainerStatuses = []v1.ContainerStatus{{Name: "app", Ready: false}, {Name: "sidecar", Ready: true}}
+	h.OnAdd(pod)
+	w.init()
+	assert.Empty(evs.list)
+
+	// the main container gets ready
+	ready := pod.DeepCopy()
+	ready.Status.ContainerStatuses[0].Ready = true
+	h.OnUpdate(pod, ready)
+	assert.Equal([]string{"add:" + key}, evs.list)
+	assert.Equal(server.States.Running, evs.get(key).GetStatus())
+
+	// terminating
+	terminating := ready.DeepCopy()
+	now := metav1.Now()
+	terminating.DeletionTimestamp = &now
+	h.OnUpdate(ready, terminating)
+	assert.True(evs.has("update:" + key))
+	assert.Equal(server.States.Stopping, evs.get(key).GetStatus())
+
+	// fails readiness while terminating
+	unready := terminating.DeepCopy()
+	unready.Status.ContainerStatuses[0].Ready = false
+	h.OnUpdate(terminating, unready)
+	assert.True(evs.has("delete:" + key))
+
+	// a pod not ready is not added
+	evs2 := newEvents()
+	w2 := newPodWatcher(evs2.handler(), "")
+	w2.init()
+	unreadyPod := newPod("ns1", "b", "game")
+	unreadyPod.Status.Conditions[0].Status = v1.ConditionFalse
+	w2.handler().OnAdd(unreadyPod)
+	assert.Empty(evs2.list)
+}
+
+func TestWatch_OutOfCluster(t *testing.T) {
+	assert := assert.New(t)
+	t.Setenv("MY_POD_NAME", "")
+	t.Setenv("MY_POD_NAMESPACE", "")
+	t.Setenv("MY_POD_IP", "")
+	client := fake.NewSimpleClientset(newPod("default", "a", "game"))
+	c := NewWithClient(DefaultOptions(), client)
+
+	ctx, cancel := context.WithCancel(context.TODO())
+	defer cancel()
+	evs := newEvents()
+	hc := health.Custom(func(*server.Server) error { return nil })
+	assert.NoError(c.Watch(ctx, "game", evs.handler(), hc))
+	assert.Equal([]string{"init:/k8s//default/game/a"}, evs.list)
+
+	// registering needs the pod itself
+	_, err := c.Start(ctx, server.NewServer("self", "game", ""))
+	assert.Error(err)
+}
+
+func TestNewWithOptions_Kubeconfig(t *testing.T) {
+	assert := assert.New(t)
+	kubeconfig := filepath.Join(t.TempDir(), "config")
+	data := `
+apiVersion: v1
+kind: Config
+clusters:
+- name: dev
+  cluster:
+    server: https://127.0.0.1:6443
+- name: prod
+  cluster:
+    server: https://10.0.0.1:6443
+contexts:
+- name: dev
+  context:
+    cluster: dev
+    namespace: games
+- name: prod
+  context:
+    cluster: prod
+current-context: dev
+`
+	assert.NoError(os.WriteFile(kubeconfig, []byte(data), 0o600))
+	opts := DefaultOptions()
+	opts.Kubeconfig = kubeconfig
+	c, err := NewWithOptions(opts)
+	assert.NoError(err)
+	assert.Equal("games", c.namespace)
+
+	opts.Context = "prod"
+	c, err = NewWithOptions(opts)
+	assert.NoError(err)
+	assert.Equal("default", c.namespace)
+}
@@ -0,0 +1,214 @@
+package k8s
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"strings"
+	"time"
+
+	"github.com/cupen/xdisco/broker"
+	"github.com/cupen/xdisco/broker/k8s/apis/v1alpha1"
+	"github.com/cupen/xdisco/eventhandler"
+	"github.com/cupen/xdisco/server"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/util/retry"
+)
+
+var errNoCRDClient = fmt.Errorf("no client of the XdiscoServer custom resources, see NewWithClients")
+
+func xdiscoServerSpec(s *server.Server) v1alpha1.XdiscoServerSpec {
+	spec := v1alpha1.XdiscoServerSpec{
+		ID:          s.ID,
+		Kind:        s.Kind,
+		Host:        s.Host,
+		Ports:       s.Ports,
+		Labels:      s.Labels,
+		Annotations: s.Annotations,
+		Status:      s.Status,
+		Weight:      s.Weight,
+	}
+	if s.Health != nil {
+		spec.Health = &v1alpha1.Health{OK: s.Health.OK, Reason: s.Health.Reason}
+	}
+	if s.Load != nil {
+		spec.Load = &v1alpha1.Load{
+			Connections: s.Load.Connections,
+			MilliCPU:    int64(math.Round(s.Load.CPU * 1000)),
+			MilliScore:  int64(math.Round(s.Load.Score * 1000)),
+		}
+	}
+	return spec
+}
+
+// xdiscoServerAsServer returns the server of the object, or nil if it is expired.
+func xdiscoServerAsServer(obj *v1alpha1.XdiscoServer, now time.Time) *server.Server {
+	spec := obj.Spec
+	if spec.LeaseDurationSeconds > 0 {
+		if spec.RenewTime == nil || now.After(spec.RenewTime.Add(time.Duration(spec.LeaseDurationSeconds)*time.Second)) {
+			return nil
+		}
+	}
+	s := &server.Server{
+		ID:          spec.ID,
+		Kind:        spec.Kind,
+		Host:        spec.Host,
+		Ports:       spec.Ports,
+		Labels:      spec.Labels,
+		Annotations: spec.Annotations,
+		Status:      spec.Status,
+		Weight:      spec.Weight,
+		CreatedAt:   obj.CreationTimestamp.Time,
+	}
+	if s.Status == "" {
+		s.SetStatus(server.States.Running)
+	}
+	if spec.RenewTime != nil {
+		s.UpdatedAt = spec.RenewTime.Time
+	}
+	if spec.Health != nil {
+		s.SetHealth(spec.Health.OK, spec.Health.Reason)
+	}
+	if spec.Load != nil {
+		s.SetLoad(server.Load{
+			Connections: spec.Load.Connections,
+			CPU:         float64(spec.Load.MilliCPU) / 1000,
+			Score:       float64(spec.Load.MilliScore) / 1000,
+		})
+	}
+	if !s.IsValid() || s.GetStatus() == server.States.Stopped {
+		return nil
+	}
+	key := strings.Join([]string{"/k8s/", obj.Namespace, s.Kind, s.ID}, "/")
+	s.SetKey(key)
+	return s
+}
+
+// setXdiscoServer writes s into the object and renews it.
+func (c *Controller) setXdiscoServer(obj *v1alpha1.XdiscoServer, s *server.Server) {
+	labels := map[string]string{}
+	for k, v := range c.opts.Selector {
+		labels[k] = v
+	}
+	labels["kind"] = kindLabel(s.Kind)
+	obj.SetLabels(labels)
+	now := metav1.Now()
+	duration := int32(c.opts.LeaseDuration / time.Second)
+	obj.Spec = xdiscoServerSpec(s)
+	obj.Spec.Holder = c.identity
+	obj.Spec.LeaseDurationSeconds = duration
+	obj.Spec.RenewTime = &now
+}
+
+// acquireXdiscoServer creates the object of s, or takes it over if it is expired or held by the process itself.
+func (c *Controller) acquireXdiscoServer(ctx context.Context, namespace, name string, s *server.Server) error {
+	api := c.crd.XdiscoServers(namespace)
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		obj, err := api.Get(ctx, name, metav1.GetOptions{})
+		if apierrors.IsNotFound(err) {
+			obj = &v1alpha1.XdiscoServer{ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: name}}
+			c.setXdiscoServer(obj, s)
+			_, err = api.Create(ctx, obj, metav1.CreateOptions{})
+			if apierrors.IsAlreadyExists(err) {
+				// created in between, get it again.
+				return apierrors.NewConflict(v1alpha1.Resource("xdiscoservers"), name, err)
+			}
+			return err
+		}
+		if err != nil {
+			return fmt.Errorf("get xdiscoserver failed. %w", err)
+		}
+		if obj.Spec.Holder != c.identity && xdiscoServerAsServer(obj, time.Now()) != nil {
+			return fmt.Errorf("%w. xdiscoserver=%s/%s holder=%s", ErrDuplicated, namespace, name, obj.Spec.Holder)
+		}
+		c.setXdiscoServer(obj, s)
+		_, err = api.Update(ctx, obj, metav1.UpdateOptions{})
+		return err
+	})
+}
+
+// releaseXdiscoServer deletes the object unless it has been taken over by another process.
+func (c *Controller) releaseXdiscoServer(ctx context.Context, namespace, name string) error {
+	api := c.crd.XdiscoServers(namespace)
+	obj, err := api.Get(ctx, name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if obj.Spec.Holder != c.identity {
+		return nil
+	}
+	err = api.Delete(ctx, name, metav1.DeleteOptions{
+		Preconditions: &metav1.Preconditions{ResourceVersion: &obj.ResourceVersion},
+	})
+	if apierrors.IsNotFound(err) {
+		return nil
+	}
+	return err
+}
+
+func (c *Controller) startXdiscoServer(ctx context.Context, s *server.Server) (broker.Registration, error) {
+	if c.crd == nil {
+		return nil, errNoCRDClient
+	}
+	namespace := c.getNameSpace()
+	name := ObjectName(s.Kind, s.ID)
+	return c.startObject(ctx, namespace, name, s, objectKeeper{
+		acquire: func(ctx context.Context, s *server.Server) error {
+			return c.acquireXdiscoServer(ctx, namespace, name, s)
+		},
+		release: func(ctx context.Context) error {
+			return c.releaseXdiscoServer(ctx, namespace, name)
+		},
+	})
+}
+
+// watchXdiscoServers watches the XdiscoServers of kind, the expired ones are taken as deleted.
+func (c *Controller) watchXdiscoServers(ctx context.Context, kind string, h eventhandler.Handler) error {
+	if c.crd == nil {
+		return errNoCRDClient
+	}
+	now := time.Now()
+	labelSelector, err := c.kindSelector(kind)
+	if err != nil {
+		return err
+	}
+	w := newWatcher(h, func(obj interface{}) *server.Server {
+		xs, ok := obj.(*v1alpha1.XdiscoServer)
+		if !ok {
+			return nil
+		}
+		if s := xdiscoServerAsServer(xs, time.Now()); s != nil && s.Kind == kind {
+			return s
+		}
+		return nil
+	})
+	crdInformer := func(ns string) cache.SharedIndexInformer {
+		api := c.crd.XdiscoServers(ns)
+		lw := &cache.ListWatch{
+			ListFunc: func(opts metav1.ListOptions) (runtime.Object, error) {
+				opts.LabelSelector = labelSelector
+				return api.List(ctx, opts)
+			},
+			WatchFunc: func(opts metav1.ListOptions) (watch.Interface, error) {
+				opts.LabelSelector = labelSelector
+				return api.Watch(ctx, opts)
+			},
+		}
+		return cache.NewSharedIndexInformer(lw, &v1alpha1.XdiscoServer{}, c.opts.Resync, cache.Indexers{})
+	}
+	runnings, err := c.runInformers(ctx, crdInformer, w.handler())
+	if err != nil {
+		return err
+	}
+	w.init()
+	go c.expire(ctx, runnings, w)
+	log2.Infof("[k8s] watch xdiscoservers started. cost: %v", time.Since(now))
+	return nil
+}
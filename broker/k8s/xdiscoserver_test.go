@@ -0,0 +1,87 @@
+package k8s
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/cupen/xdisco/broker/k8s/apis/v1alpha1"
+	"github.com/cupen/xdisco/health"
+	"github.com/cupen/xdisco/server"
+	"github.com/stretchr/testify/assert"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestXdiscoServer(t *testing.T) {
+	assert := assert.New(t)
+	t.Setenv("MY_POD_NAME", "self")
+	t.Setenv("MY_POD_NAMESPACE", "ns1")
+	t.Setenv("MY_POD_IP", "127.0.0.1")
+	dyn := dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(),
+		map[schema.GroupVersionResource]string{v1alpha1.XdiscoServerResource: "XdiscoServerList"})
+	crd := v1alpha1.NewClient(dyn)
+
+	// a VM registered statically
+	vm := &v1alpha1.XdiscoServer{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "ns1", Name: ObjectName("game", "vm-1"), Labels: map[string]string{"kind": "game"}},
+		Spec: v1alpha1.XdiscoServerSpec{
+			ID:    "vm-1",
+			Kind:  "game",
+			Host:  "192.168.0.1",
+			Ports: map[string]int{"grpc": 9000},
+		},
+	}
+	_, err := crd.XdiscoServers("ns1").Create(context.TODO(), vm, metav1.CreateOptions{})
+	assert.NoError(err)
+
+	opts := DefaultOptions()
+	opts.Mode = ModeXdiscoServers
+	opts.Registration = RegisterXdiscoServer
+	opts.LeaseDuration = 3 * time.Second
+	c := NewWithClients(opts, fake.NewSimpleClientset(), dyn)
+
+	ctx, cancel := context.WithCancel(context.TODO())
+	defer cancel()
+	evs := newEvents()
+	hc := health.Custom(func(*server.Server) error { return nil })
+	assert.NoError(c.Watch(ctx, "game", evs.handler(), hc))
+	assert.Equal([]string{"init:/k8s//ns1/game/vm-1"}, evs.list)
+	assert.Equal("192.168.0.1:9000", evs.get("/k8s//ns1/game/vm-1").PrivateAddress("grpc"))
+
+	s := server.NewServer("1", "game", "10.0.0.1")
+	s.SetLoad(server.Load{Connections: 3, CPU: 0.25})
+	reg, err := c.Start(ctx, s)
+	if !assert.NoError(err) {
+		return
+	}
+	key := "/k8s//ns1/game/1"
+	assert.Eventually(func() bool { return evs.has("add:" + key) }, waitFor, 10*time.Millisecond)
+	assert.Equal(0.25, evs.get(key).Load.CPU)
+
+	obj, err := crd.XdiscoServers("ns1").Get(context.TODO(), ObjectName("game", "1"), metav1.GetOptions{})
+	assert.NoError(err)
+	assert.Equal(c.identity, obj.Spec.Holder)
+	assert.Equal(int64(250), obj.Spec.Load.MilliCPU)
+
+	// the static one can't be taken over
+	_, err = c.Start(ctx, server.NewServer("vm-1", "game", "10.0.0.1"))
+	assert.ErrorIs(err, ErrDuplicated)
+	vmObj, err := crd.XdiscoServers("ns1").Get(context.TODO(), ObjectName("game", "vm-1"), metav1.GetOptions{})
+	assert.NoError(err)
+	assert.Equal("", vmObj.Spec.Holder)
+	assert.Equal("192.168.0.1", vmObj.Spec.Host)
+
+	reg.SetWeight(7)
+	assert.Eventually(func() bool { return evs.get(key).Weight == 7 }, waitFor, 10*time.Millisecond)
+
+	assert.NoError(reg.Deregister(context.TODO()))
+	assert.Eventually(func() bool { return evs.has("delete:" + key) }, waitFor, 10*time.Millisecond)
+
+	// expired objects are not serving
+	obj.Spec.RenewTime = &metav1.Time{Time: time.Now().Add(-time.Minute)}
+	assert.Nil(xdiscoServerAsServer(obj, time.Now()))
+}
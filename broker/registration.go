@@ -0,0 +1,158 @@
+package broker
+
+import (
+	"context"
+	"errors"
+	"sync"
+
+	"github.com/cupen/xdisco/server"
+)
+
+// Registration is a handle of a server registered by Sevice.Start.
+type Registration interface {
+	// Server returns a copy of the registered server.
+	Server() *server.Server
+	Update(func(*server.Server))
+	SetState(server.State)
+	SetHealth(ok bool, reason string)
+	SetLabels(map[string]string)
+	SetAnnotation(name, value string)
+	SetWeight(int)
+	SetPort(name string, port int)
+	SetLoad(server.Load)
+	// Flush publishes the pending changes right away rather than after the update interval,
+	// and returns once they are written.
+	Flush(context.Context) error
+	Deregister(context.Context) error
+	// Done is closed once the server is deregistered.
+	Done() <-chan struct{}
+}
+
+// ErrDeregistered means the server is deregistered already.
+var ErrDeregistered = errors.New("server deregistered")
+
+// Record keeps the registered server for the broker implementations.
+// Changes are applied under its lock and signaled through Changed,
+// the broker is expected to publish Server() after each signal,
+// and right away on each request of Flushes, answering it with the result.
+type Record struct {
+	mu      sync.Mutex
+	s       *server.Server
+	changed chan struct{}
+	flushes chan chan error
+	done    chan struct{}
+	once    sync.Once
+}
+
+func NewRecord(s *server.Server) *Record {
+	return &Record{
+		s:       s.Clone(),
+		changed: make(chan struct{}, 1),
+		flushes: make(chan chan error),
+		done:    make(chan struct{}),
+	}
+}
+
+func (r *Record) Server() *server.Server {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.s.Clone()
+}
+
+func (r *Record) Update(f func(*server.Server)) {
+	r.mu.Lock()
+	f(r.s)
+	r.mu.Unlock()
+	select {
+	case r.changed <- struct{}{}:
+	default:
+	}
+}
+
+func (r *Record) SetState(state server.State) {
+	r.Update(func(s *server.Server) {
+		s.SetStatus(state)
+	})
+}
+
+func (r *Record) SetHealth(ok bool, reason string) {
+	r.Update(func(s *server.Server) {
+		s.SetHealth(ok, reason)
+	})
+}
+
+func (r *Record) SetLabels(labels map[string]string) {
+	r.Update(func(s *server.Server) {
+		if s.Labels == nil {
+			s.Labels = map[string]string{}
+		}
+		for k, v := range labels {
+			s.Labels[k] = v
+		}
+	})
+}
+
+func (r *Record) SetAnnotation(name, value string) {
+	r.Update(func(s *server.Server) {
+		s.SetAnnotation(name, value)
+	})
+}
+
+func (r *Record) SetWeight(weight int) {
+	r.Update(func(s *server.Server) {
+		s.Weight = weight
+	})
+}
+
+func (r *Record) SetPort(name string, port int) {
+	r.Update(func(s *server.Server) {
+		if s.Ports == nil {
+			s.Ports = map[string]int{}
+		}
+		s.Ports[name] = port
+	})
+}
+
+func (r *Record) SetLoad(load server.Load) {
+	r.Update(func(s *server.Server) {
+		s.SetLoad(load)
+	})
+}
+
+// Changed is signaled after the server has been updated.
+func (r *Record) Changed() <-chan struct{} {
+	return r.changed
+}
+
+func (r *Record) Flush(ctx context.Context) error {
+	req := make(chan error, 1)
+	select {
+	case r.flushes <- req:
+	case <-r.done:
+		return ErrDeregistered
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	select {
+	case err := <-req:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Flushes delivers the requests of Flush, each is answered with the result of publishing the server.
+func (r *Record) Flushes() <-chan chan error {
+	return r.flushes
+}
+
+func (r *Record) Done() <-chan struct{} {
+	return r.done
+}
+
+// Close marks the record as deregistered.
+func (r *Record) Close() {
+	r.once.Do(func() {
+		close(r.done)
+	})
+}
@@ -0,0 +1,34 @@
+package broker
+
+import (
+	"testing"
+
+	"github.com/cupen/xdisco/server"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRecord(t *testing.T) {
+	assert := assert.New(t)
+	s := server.NewServer("1", "test", "127.0.0.1")
+	r := NewRecord(s)
+
+	r.SetState(server.States.Running)
+	r.SetLabels(map[string]string{"zone": "a"})
+	r.SetAnnotation("map", "v2")
+	select {
+	case <-r.Changed():
+	default:
+		assert.FailNow("change not signaled")
+	}
+
+	snapshot := r.Server()
+	assert.Equal(server.States.Running, snapshot.GetStatus())
+	assert.Equal("a", snapshot.GetLabel("zone"))
+	snapshot.Labels["zone"] = "b"
+	assert.Equal("a", r.Server().GetLabel("zone"))
+	assert.Equal("", s.GetLabel("zone"))
+
+	r.Close()
+	r.Close()
+	<-r.Done()
+}
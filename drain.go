@@ -0,0 +1,85 @@
+package xdisco
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/cupen/xdisco/broker"
+	"github.com/cupen/xdisco/server"
+	"go.uber.org/zap"
+)
+
+type DrainOptions struct {
+	// how long watchers are given to observe the stopping state
+	Grace time.Duration
+
+	// reports the work still in flight on the server, drain waits for it to reach zero
+	InFlight func() int
+
+	// interval of polling InFlight
+	Interval time.Duration
+}
+
+func (o *DrainOptions) withDefault() {
+	if o.Grace <= 0 {
+		o.Grace = 3 * time.Second
+	}
+	if o.Interval <= 0 {
+		o.Interval = 200 * time.Millisecond
+	}
+}
+
+// Drain takes a registered server out of rotation before deregistering it:
+// it publishes States.Stopping and waits for it to be written, gives watchers the grace period to observe it,
+// waits for the in-flight work to finish and then deregisters the server.
+// The timeout bounds the waiting, the server is deregistered even if it elapses.
+func Drain(ctx context.Context, reg broker.Registration, timeout time.Duration, opts DrainOptions) error {
+	s := reg.Server()
+	if !s.IsValid() {
+		return fmt.Errorf("invalid server: %+v", s)
+	}
+	opts.withDefault()
+	now := time.Now()
+	log := log.With(zap.String("kind", s.Kind), zap.String("id", s.ID))
+
+	waitCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	reg.SetState(server.States.Stopping)
+	// the grace period counts from the stopping state being written, not from being queued.
+	if err := reg.Flush(waitCtx); err != nil {
+		log.Warn("[drain] publish stopping failed", zap.Error(err))
+	}
+	log.Info("[drain] stopping")
+
+	grace := time.NewTimer(opts.Grace)
+	defer grace.Stop()
+	select {
+	case <-grace.C:
+	case <-waitCtx.Done():
+	}
+
+	if opts.InFlight != nil {
+		ticker := time.NewTicker(opts.Interval)
+		defer ticker.Stop()
+		for opts.InFlight() > 0 && waitCtx.Err() == nil {
+			select {
+			case <-ticker.C:
+			case <-waitCtx.Done():
+			}
+		}
+		if n := opts.InFlight(); n > 0 {
+			log.Warn("[drain] timed out with work in flight", zap.Int("inflight", n))
+		}
+	}
+
+	stopCtx, stopCancel := context.WithTimeout(context.TODO(), 6*time.Second)
+	defer stopCancel()
+	if err := reg.Deregister(stopCtx); err != nil {
+		log.Warn("[drain] stop failed", zap.Error(err))
+		return err
+	}
+	log.Info("[drain] stopped", zap.Duration("cost", time.Since(now)))
+	return nil
+}
@@ -0,0 +1,96 @@
+package xdisco
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/cupen/xdisco/broker"
+	"github.com/cupen/xdisco/server"
+	"github.com/stretchr/testify/assert"
+)
+
+type fakeRegistration struct {
+	*broker.Record
+	states  []server.State
+	stopped bool
+	// states written by the flushes
+	flushed chan server.State
+}
+
+// newFakeRegistration returns a registration whose flushes take delay to be written.
+func newFakeRegistration(delay time.Duration) *fakeRegistration {
+	s := NewServer("1", "test", "127.0.0.1")
+	reg := &fakeRegistration{Record: broker.NewRecord(s), flushed: make(chan server.State, 10)}
+	go func() {
+		for {
+			select {
+			case req := <-reg.Flushes():
+				time.Sleep(delay)
+				reg.flushed <- reg.Server().GetStatus()
+				req <- nil
+			case <-reg.Done():
+				return
+			}
+		}
+	}()
+	return reg
+}
+
+func (f *fakeRegistration) SetState(state server.State) {
+	f.states = append(f.states, state)
+	f.Record.SetState(state)
+}
+
+func (f *fakeRegistration) Deregister(context.Context) error {
+	f.stopped = true
+	f.Close()
+	return nil
+}
+
+func TestDrain(t *testing.T) {
+	t.Run("inflight", func(t *testing.T) {
+		assert := assert.New(t)
+		reg := newFakeRegistration(0)
+		var inflight int32 = 3
+		go func() {
+			for atomic.AddInt32(&inflight, -1) > 0 {
+				time.Sleep(20 * time.Millisecond)
+			}
+		}()
+		opts := DrainOptions{
+			Grace:    10 * time.Millisecond,
+			Interval: 5 * time.Millisecond,
+			InFlight: func() int { return int(atomic.LoadInt32(&inflight)) },
+		}
+		assert.NoError(Drain(context.TODO(), reg, time.Second, opts))
+		assert.Equal([]server.State{server.States.Stopping}, reg.states)
+		assert.Equal(server.States.Stopping, <-reg.flushed)
+		assert.Equal(int32(0), atomic.LoadInt32(&inflight))
+		assert.True(reg.stopped)
+	})
+
+	t.Run("timeout", func(t *testing.T) {
+		assert := assert.New(t)
+		reg := newFakeRegistration(0)
+		opts := DrainOptions{
+			Grace:    10 * time.Millisecond,
+			InFlight: func() int { return 1 },
+		}
+		now := time.Now()
+		assert.NoError(Drain(context.TODO(), reg, 100*time.Millisecond, opts))
+		assert.Less(time.Since(now), time.Second)
+		assert.True(reg.stopped)
+	})
+
+	t.Run("graceAfterFlush", func(t *testing.T) {
+		assert := assert.New(t)
+		reg := newFakeRegistration(100 * time.Millisecond)
+		now := time.Now()
+		assert.NoError(Drain(context.TODO(), reg, time.Second, DrainOptions{Grace: 100 * time.Millisecond}))
+		assert.GreaterOrEqual(time.Since(now), 200*time.Millisecond)
+		assert.Equal(server.States.Stopping, <-reg.flushed)
+		assert.True(reg.stopped)
+	})
+}
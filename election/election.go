@@ -0,0 +1,99 @@
+package election
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/cupen/xdisco/logs"
+	"github.com/cupen/xdisco/server"
+)
+
+var (
+	log  = logs.Logger("info")
+	log2 = log.Sugar()
+)
+
+// ErrCampaigning means Campaign is called again before Resign.
+var ErrCampaigning = errors.New("campaign in progress")
+
+// Election elects one leader among the candidates of a kind.
+type Election interface {
+	// Campaign blocks until candidate is elected or ctx is done.
+	// The leadership is kept until Resign, or until it is lost, then Campaign again to rejoin.
+	Campaign(ctx context.Context, kind string, candidate *server.Server) error
+
+	// Resign gives up the leadership, or the campaign in progress.
+	Resign(ctx context.Context) error
+
+	// Leader returns the leader observed while campaigning, nil if there is none.
+	Leader() *server.Server
+
+	// OnLeaderChanged sets the callback invoked when the leader observed changes, nil means there is none.
+	OnLeaderChanged(callback func(*server.Server))
+}
+
+type Options struct {
+	// how long the leadership outlives a leader gone without resigning
+	TTL time.Duration `json:"ttl" toml:"ttl"`
+}
+
+func DefaultOptions() *Options {
+	return &Options{
+		TTL: 15 * time.Second,
+	}
+}
+
+func (c *Options) WithDefault() *Options {
+	defaultOptions := DefaultOptions()
+	if c.TTL < time.Second {
+		c.TTL = defaultOptions.TTL
+	}
+	return c
+}
+
+// leaderState keeps the leader observed and notifies the changes.
+type leaderState struct {
+	mu        sync.Mutex
+	leader    *server.Server
+	onChanged func(*server.Server)
+}
+
+func (l *leaderState) Leader() *server.Server {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.leader
+}
+
+func (l *leaderState) OnLeaderChanged(callback func(*server.Server)) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.onChanged = callback
+}
+
+func (l *leaderState) setLeader(s *server.Server) {
+	l.mu.Lock()
+	old := l.leader
+	l.leader = s
+	callback := l.onChanged
+	l.mu.Unlock()
+	if sameLeader(old, s) {
+		return
+	}
+	if s != nil {
+		log2.Infof("[election] leader changed. kind=%s id=%s", s.Kind, s.ID)
+	} else {
+		log2.Infof("[election] leader gone")
+	}
+	if callback != nil {
+		callback(s)
+	}
+}
+
+func sameLeader(a, b *server.Server) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return a.Kind == b.Kind && a.ID == b.ID
+}
@@ -0,0 +1,147 @@
+package election
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cupen/xdisco/broker/etcd"
+	"github.com/cupen/xdisco/server"
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"go.etcd.io/etcd/client/v3/concurrency"
+)
+
+// Etcd elects the leader with the election of etcd concurrency, in the keyspace of an etcd broker.
+// The candidates are kept under BaseKey/_election/kind, out of the keys watched by the broker.
+type Etcd struct {
+	leaderState
+	client  *clientv3.Client
+	baseKey string
+	opts    *Options
+
+	mu       sync.Mutex
+	campaign *etcdCampaign
+}
+
+type etcdCampaign struct {
+	session  *concurrency.Session
+	election *concurrency.Election
+	// stops observing the leader and waiting for the leadership
+	cancel context.CancelFunc
+}
+
+func (c *etcdCampaign) close() {
+	c.cancel()
+	if err := c.session.Close(); err != nil {
+		log2.Warnf("[election] close etcd session failed. err:%v", err)
+	}
+}
+
+func NewEtcd(bk *etcd.Etcd, opts *Options) *Etcd {
+	return &Etcd{
+		client:  bk.Client(),
+		baseKey: bk.BaseKey(),
+		opts:    opts.WithDefault(),
+	}
+}
+
+func (e *Etcd) electionKey(kind string) string {
+	return strings.Join([]string{e.baseKey, "_election", kind}, "/")
+}
+
+func (e *Etcd) Campaign(ctx context.Context, kind string, candidate *server.Server) error {
+	if !candidate.IsValid() {
+		return fmt.Errorf("invalid server: %+v", candidate)
+	}
+	value, err := json.Marshal(candidate)
+	if err != nil {
+		return err
+	}
+	e.mu.Lock()
+	if e.campaign != nil {
+		e.mu.Unlock()
+		return ErrCampaigning
+	}
+	ttl := int(e.opts.TTL / time.Second)
+	session, err := concurrency.NewSession(e.client, concurrency.WithTTL(ttl))
+	if err != nil {
+		e.mu.Unlock()
+		return fmt.Errorf("create etcd session failed. %w", err)
+	}
+	key := e.electionKey(kind)
+	observeCtx, cancelObserve := context.WithCancel(context.Background())
+	waitCtx, cancelWait := context.WithCancel(ctx)
+	c := &etcdCampaign{
+		session:  session,
+		election: concurrency.NewElection(session, key),
+		cancel: func() {
+			cancelWait()
+			cancelObserve()
+		},
+	}
+	e.campaign = c
+	e.mu.Unlock()
+
+	go e.observe(observeCtx, c.election)
+	if err := c.election.Campaign(waitCtx, string(value)); err != nil {
+		e.end(c)
+		return fmt.Errorf("campaign failed. key=%s %w", key, err)
+	}
+	log2.Infof("[election] elected. key=%s id=%s", key, candidate.ID)
+	e.setLeader(candidate)
+	go func() {
+		select {
+		case <-session.Done():
+			log2.Warnf("[election] leadership lost with the etcd session. key=%s id=%s", key, candidate.ID)
+			if e.end(c) {
+				e.setLeader(nil)
+			}
+		case <-observeCtx.Done():
+		}
+	}()
+	return nil
+}
+
+// end stops the campaign unless it is stopped already.
+func (e *Etcd) end(c *etcdCampaign) bool {
+	e.mu.Lock()
+	current := e.campaign == c
+	if current {
+		e.campaign = nil
+	}
+	e.mu.Unlock()
+	if current {
+		c.close()
+	}
+	return current
+}
+
+func (e *Etcd) observe(ctx context.Context, election *concurrency.Election) {
+	for resp := range election.Observe(ctx) {
+		if len(resp.Kvs) <= 0 || ctx.Err() != nil {
+			continue
+		}
+		s := &server.Server{}
+		if err := json.Unmarshal(resp.Kvs[0].Value, s); err != nil {
+			log2.Warnf("[election] invalid leader. key=%s err:%v", resp.Kvs[0].Key, err)
+			continue
+		}
+		e.setLeader(s)
+	}
+}
+
+func (e *Etcd) Resign(ctx context.Context) error {
+	e.mu.Lock()
+	c := e.campaign
+	e.campaign = nil
+	e.mu.Unlock()
+	if c == nil {
+		return nil
+	}
+	defer e.setLeader(nil)
+	defer c.close()
+	return c.election.Resign(ctx)
+}
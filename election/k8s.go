@@ -0,0 +1,263 @@
+package election
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+
+	"github.com/cupen/xdisco/broker/k8s"
+	"github.com/cupen/xdisco/server"
+	coordinationv1 "k8s.io/api/coordination/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	coordinationv1client "k8s.io/client-go/kubernetes/typed/coordination/v1"
+	"k8s.io/client-go/tools/leaderelection"
+	"k8s.io/client-go/tools/leaderelection/resourcelock"
+)
+
+// annotation of the Lease holding the leader
+const leaderAnnotation = "xdisco/v1/leader"
+
+// K8s elects the leader with a Lease lock in the namespace of a k8s broker,
+// the Lease of kind is named by k8s.LeaderLeaseName and the candidates are identified by their IDs within the process,
+// so the same ID campaigning from two processes is still two candidates.
+type K8s struct {
+	leaderState
+	client    kubernetes.Interface
+	namespace string
+	identity  string // of the process
+	opts      *Options
+
+	mu       sync.Mutex
+	campaign *k8sCampaign
+}
+
+type k8sCampaign struct {
+	cancel context.CancelFunc
+	// closed when the elector stops
+	done chan struct{}
+}
+
+func NewK8s(c *k8s.Controller, opts *Options) *K8s {
+	return &K8s{
+		client:    c.Client(),
+		namespace: c.Namespace(),
+		identity:  c.Identity(),
+		opts:      opts.WithDefault(),
+	}
+}
+
+func (k *K8s) Campaign(ctx context.Context, kind string, candidate *server.Server) error {
+	if !candidate.IsValid() {
+		return fmt.Errorf("invalid server: %+v", candidate)
+	}
+	value, err := json.Marshal(candidate)
+	if err != nil {
+		return err
+	}
+	lock := &leaseLock{
+		meta:      metav1.ObjectMeta{Namespace: k.namespace, Name: k8s.LeaderLeaseName(kind)},
+		client:    k.client.CoordinationV1(),
+		identity:  k.identity + "_" + candidate.ID,
+		candidate: string(value),
+	}
+	runCtx, cancel := context.WithCancel(context.Background())
+	elected := make(chan struct{})
+	ttl := k.opts.TTL
+	elector, err := leaderelection.NewLeaderElector(leaderelection.LeaderElectionConfig{
+		Lock:            lock,
+		LeaseDuration:   ttl,
+		RenewDeadline:   ttl * 2 / 3,
+		RetryPeriod:     ttl / 5,
+		ReleaseOnCancel: true,
+		Name:            lock.Describe(),
+		Callbacks: leaderelection.LeaderCallbacks{
+			OnStartedLeading: func(context.Context) { close(elected) },
+			OnStoppedLeading: func() {},
+			OnNewLeader: func(identity string) {
+				if runCtx.Err() == nil {
+					k.setLeader(lock.holder(identity))
+				}
+			},
+		},
+	})
+	if err != nil {
+		cancel()
+		return fmt.Errorf("invalid election options. %w", err)
+	}
+
+	k.mu.Lock()
+	if k.campaign != nil {
+		k.mu.Unlock()
+		cancel()
+		return ErrCampaigning
+	}
+	c := &k8sCampaign{cancel: cancel, done: make(chan struct{})}
+	k.campaign = c
+	k.mu.Unlock()
+
+	go func() {
+		defer close(c.done)
+		// returns when the leadership is lost, or the campaign is stopped.
+		elector.Run(runCtx)
+		if k.end(c) {
+			log2.Warnf("[election] leadership lost. lease=%s id=%s", lock.Describe(), candidate.ID)
+			k.setLeader(nil)
+		}
+	}()
+	select {
+	case <-elected:
+		log2.Infof("[election] elected. lease=%s id=%s", lock.Describe(), candidate.ID)
+		k.setLeader(candidate)
+		return nil
+	case <-c.done:
+		return fmt.Errorf("campaign stopped. lease=%s", lock.Describe())
+	case <-ctx.Done():
+		k.end(c)
+		<-c.done
+		return ctx.Err()
+	}
+}
+
+// end stops the campaign unless it is stopped already.
+func (k *K8s) end(c *k8sCampaign) bool {
+	k.mu.Lock()
+	current := k.campaign == c
+	if current {
+		k.campaign = nil
+	}
+	k.mu.Unlock()
+	if current {
+		c.cancel()
+	}
+	return current
+}
+
+func (k *K8s) Resign(ctx context.Context) error {
+	k.mu.Lock()
+	c := k.campaign
+	k.campaign = nil
+	k.mu.Unlock()
+	if c == nil {
+		return nil
+	}
+	defer k.setLeader(nil)
+	// the elector releases the lease on stopping.
+	c.cancel()
+	select {
+	case <-c.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// leaseLock is the Lease lock of client-go, which keeps the candidate holding the lock in an annotation.
+type leaseLock struct {
+	meta      metav1.ObjectMeta
+	client    coordinationv1client.LeasesGetter
+	identity  string
+	candidate string
+
+	mu    sync.Mutex
+	lease *coordinationv1.Lease
+}
+
+func (l *leaseLock) Get(ctx context.Context) (*resourcelock.LeaderElectionRecord, []byte, error) {
+	lease, err := l.client.Leases(l.meta.Namespace).Get(ctx, l.meta.Name, metav1.GetOptions{})
+	if err != nil {
+		return nil, nil, err
+	}
+	l.setLease(lease)
+	record := resourcelock.LeaseSpecToLeaderElectionRecord(&lease.Spec)
+	raw, err := json.Marshal(record)
+	if err != nil {
+		return nil, nil, err
+	}
+	return record, raw, nil
+}
+
+func (l *leaseLock) Create(ctx context.Context, ler resourcelock.LeaderElectionRecord) error {
+	lease := &coordinationv1.Lease{
+		ObjectMeta: metav1.ObjectMeta{Namespace: l.meta.Namespace, Name: l.meta.Name},
+	}
+	l.setRecord(lease, ler)
+	lease, err := l.client.Leases(l.meta.Namespace).Create(ctx, lease, metav1.CreateOptions{})
+	if err != nil {
+		return err
+	}
+	l.setLease(lease)
+	return nil
+}
+
+func (l *leaseLock) Update(ctx context.Context, ler resourcelock.LeaderElectionRecord) error {
+	l.mu.Lock()
+	if l.lease == nil {
+		l.mu.Unlock()
+		return fmt.Errorf("lease not initialized, call get or create first")
+	}
+	lease := l.lease.DeepCopy()
+	l.mu.Unlock()
+	l.setRecord(lease, ler)
+	lease, err := l.client.Leases(l.meta.Namespace).Update(ctx, lease, metav1.UpdateOptions{})
+	if err != nil {
+		return err
+	}
+	l.setLease(lease)
+	return nil
+}
+
+// setRecord writes the record into the lease, with the candidate if it is the holder.
+func (l *leaseLock) setRecord(lease *coordinationv1.Lease, ler resourcelock.LeaderElectionRecord) {
+	lease.Spec = resourcelock.LeaderElectionRecordToLeaseSpec(&ler)
+	annotations := map[string]string{}
+	for k, v := range lease.Annotations {
+		annotations[k] = v
+	}
+	if ler.HolderIdentity == l.identity {
+		annotations[leaderAnnotation] = l.candidate
+	} else {
+		delete(annotations, leaderAnnotation)
+	}
+	lease.SetAnnotations(annotations)
+}
+
+func (l *leaseLock) setLease(lease *coordinationv1.Lease) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.lease = lease
+}
+
+// holder returns the candidate holding the lease as identity.
+func (l *leaseLock) holder(identity string) *server.Server {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if identity == "" || l.lease == nil {
+		return nil
+	}
+	holder := l.lease.Spec.HolderIdentity
+	if holder == nil || *holder != identity {
+		return nil
+	}
+	data, ok := l.lease.Annotations[leaderAnnotation]
+	if !ok {
+		return nil
+	}
+	s := &server.Server{}
+	if err := json.Unmarshal([]byte(data), s); err != nil {
+		log2.Warnf("[election] invalid leader. lease=%s err:%v", l.Describe(), err)
+		return nil
+	}
+	return s
+}
+
+func (l *leaseLock) RecordEvent(string) {}
+
+func (l *leaseLock) Identity() string {
+	return l.identity
+}
+
+func (l *leaseLock) Describe() string {
+	return l.meta.Namespace + "/" + l.meta.Name
+}
@@ -0,0 +1,71 @@
+package election
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/cupen/xdisco/broker/k8s"
+	"github.com/cupen/xdisco/server"
+	"github.com/stretchr/testify/assert"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestK8s(t *testing.T) {
+	assert := assert.New(t)
+	client := fake.NewSimpleClientset()
+	c := k8s.NewWithClient(k8s.DefaultOptions(), client)
+	opts := &Options{TTL: 2 * time.Second}
+	a, b := NewK8s(c, opts), NewK8s(c, opts)
+	leaders := make(chan *server.Server, 10)
+	b.OnLeaderChanged(func(s *server.Server) { leaders <- s })
+
+	ctx := context.TODO()
+	assert.NoError(a.Campaign(ctx, "scheduler", server.NewServer("a", "scheduler", "10.0.0.1")))
+	assert.Equal("a", a.Leader().ID)
+	assert.ErrorIs(a.Campaign(ctx, "scheduler", server.NewServer("a", "scheduler", "10.0.0.1")), ErrCampaigning)
+
+	lease, err := client.CoordinationV1().Leases(c.Namespace()).Get(ctx, k8s.LeaderLeaseName("scheduler"), metav1.GetOptions{})
+	assert.NoError(err)
+	assert.Equal(c.Identity()+"_a", *lease.Spec.HolderIdentity)
+
+	// the same ID from another process does not lead too
+	other := NewK8s(c, opts)
+	other.identity = "other_1"
+	timeout, cancel := context.WithTimeout(ctx, 500*time.Millisecond)
+	defer cancel()
+	assert.ErrorIs(other.Campaign(timeout, "scheduler", server.NewServer("a", "scheduler", "10.0.0.3")), context.DeadlineExceeded)
+	assert.Equal("10.0.0.1", a.Leader().Host)
+
+	// a follower observes the leader while campaigning
+	elected := make(chan error, 1)
+	go func() {
+		elected <- b.Campaign(ctx, "scheduler", server.NewServer("b", "scheduler", "10.0.0.2"))
+	}()
+	select {
+	case s := <-leaders:
+		assert.Equal("10.0.0.1", s.Host)
+	case <-time.After(3 * time.Second):
+		t.Fatal("leader not observed")
+	}
+
+	// takes over once the leader resigns
+	assert.NoError(a.Resign(ctx))
+	assert.Nil(a.Leader())
+	select {
+	case err := <-elected:
+		assert.NoError(err)
+	case <-time.After(3 * time.Second):
+		t.Fatal("not elected after the leader resigned")
+	}
+	assert.Equal("b", b.Leader().ID)
+	assert.NoError(b.Resign(ctx))
+
+	// campaign given up with ctx
+	assert.NoError(a.Campaign(ctx, "scheduler", server.NewServer("a", "scheduler", "10.0.0.1")))
+	timeout, cancel = context.WithTimeout(ctx, 100*time.Millisecond)
+	defer cancel()
+	assert.ErrorIs(b.Campaign(timeout, "scheduler", server.NewServer("b", "scheduler", "10.0.0.2")), context.DeadlineExceeded)
+	assert.NoError(a.Resign(ctx))
+}
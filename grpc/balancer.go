@@ -0,0 +1,72 @@
+package grpc
+
+import (
+	"context"
+	"sort"
+	"sync/atomic"
+
+	"github.com/cupen/xdisco/lookup"
+	"google.golang.org/grpc/balancer"
+	"google.golang.org/grpc/balancer/base"
+	"google.golang.org/grpc/metadata"
+)
+
+// Name of the balancer picking the server of a call by the rendezvous hashing of its hash key,
+// the same server ServerList.Lookup returns for the key while all the servers are ready.
+const Name = "xdisco_rendezvous"
+
+// HashKey is the metadata of a call holding its hash key, the calls without it are spread round robin.
+const HashKey = "xdisco-hash-key"
+
+// ServiceConfig selects the balancer, give it to grpc.WithDefaultServiceConfig.
+const ServiceConfig = `{"loadBalancingConfig":[{"` + Name + `":{}}]}`
+
+func init() {
+	balancer.Register(base.NewBalancerBuilder(Name, &pickerBuilder{}, base.Config{}))
+}
+
+// WithHashKey returns a context of the calls routed by key.
+func WithHashKey(ctx context.Context, key string) context.Context {
+	return metadata.AppendToOutgoingContext(ctx, HashKey, key)
+}
+
+type pickerBuilder struct{}
+
+func (*pickerBuilder) Build(info base.PickerBuildInfo) balancer.Picker {
+	if len(info.ReadySCs) <= 0 {
+		return base.NewErrPicker(balancer.ErrNoSubConnAvailable)
+	}
+	p := &picker{subConns: map[string]balancer.SubConn{}}
+	for sc, scInfo := range info.ReadySCs {
+		id := serverID(scInfo.Address)
+		if id == "" {
+			id = scInfo.Address.Addr
+		}
+		p.subConns[id] = sc
+		p.ids = append(p.ids, id)
+	}
+	sort.Strings(p.ids)
+	p.rdz = lookup.NewRendezvous(p.ids)
+	return p
+}
+
+type picker struct {
+	ids      []string
+	subConns map[string]balancer.SubConn
+	rdz      *lookup.Rendezvous
+	next     uint32
+}
+
+func (p *picker) Pick(info balancer.PickInfo) (balancer.PickResult, error) {
+	var id string
+	if md, ok := metadata.FromOutgoingContext(info.Ctx); ok {
+		if keys := md.Get(HashKey); len(keys) > 0 {
+			id = p.rdz.Get(keys[0])
+		}
+	}
+	if id == "" {
+		i := atomic.AddUint32(&p.next, 1)
+		id = p.ids[int(i)%len(p.ids)]
+	}
+	return balancer.PickResult{SubConn: p.subConns[id]}, nil
+}
@@ -0,0 +1,158 @@
+package grpc
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/cupen/xdisco"
+	"github.com/cupen/xdisco/broker"
+	"github.com/cupen/xdisco/eventhandler"
+	"github.com/cupen/xdisco/health"
+	"github.com/cupen/xdisco/server"
+	"github.com/stretchr/testify/assert"
+	grpclib "google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	grpchealth "google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+// fakeBroker emits the events of the servers set by the test.
+type fakeBroker struct {
+	broker.Broker
+	servers []*server.Server
+	h       eventhandler.Handler
+}
+
+func (b *fakeBroker) Watch(ctx context.Context, kind string, h eventhandler.Handler, hc server.Checker) error {
+	b.h = h
+	h.OnInit(b.servers)
+	return nil
+}
+
+// startServer starts a grpc server serving the health service named after id only.
+func startServer(t *testing.T, id string) *server.Server {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := grpclib.NewServer()
+	hs := grpchealth.NewServer()
+	hs.SetServingStatus(id, healthpb.HealthCheckResponse_SERVING)
+	healthpb.RegisterHealthServer(srv, hs)
+	go srv.Serve(lis)
+	t.Cleanup(srv.Stop)
+
+	s := server.NewServer(id, "greeter", "127.0.0.1")
+	s.Ports["grpc"] = lis.Addr().(*net.TCPAddr).Port
+	s.SetKey("/test/greeter/" + id)
+	return s
+}
+
+// servedBy returns the ID of the server handling the call of key.
+func servedBy(ctx context.Context, client healthpb.HealthClient, key string, ids []string) string {
+	for _, id := range ids {
+		_, err := client.Check(WithHashKey(ctx, key), &healthpb.HealthCheckRequest{Service: id})
+		if err == nil {
+			return id
+		}
+	}
+	return ""
+}
+
+func TestResolverAndBalancer(t *testing.T) {
+	assert := assert.New(t)
+	ids := []string{"1", "2", "3"}
+	bk := &fakeBroker{}
+	for _, id := range ids {
+		bk.servers = append(bk.servers, startServer(t, id))
+	}
+	svc := xdisco.NewService("greeter", bk, health.Custom(func(*server.Server) error { return nil }))
+	assert.NoError(svc.Start(context.TODO()))
+	Register(svc)
+
+	conn, err := grpclib.Dial("xdisco:///greeter?port=grpc",
+		grpclib.WithTransportCredentials(insecure.NewCredentials()),
+		grpclib.WithDefaultServiceConfig(ServiceConfig))
+	if !assert.NoError(err) {
+		return
+	}
+	defer conn.Close()
+	client := healthpb.NewHealthClient(conn)
+	ctx, cancel := context.WithTimeout(context.TODO(), 5*time.Second)
+	defer cancel()
+
+	// wait for all the servers to be ready
+	assert.Eventually(func() bool {
+		served := map[string]bool{}
+		for i := 0; i < 30; i++ {
+			served[servedBy(ctx, client, fmt.Sprintf("user-%d", i), ids)] = true
+		}
+		return len(served) == len(ids)
+	}, 3*time.Second, 50*time.Millisecond)
+
+	// the calls of a key go to the server chosen by the service
+	for i := 0; i < 20; i++ {
+		key := fmt.Sprintf("user-%d", i)
+		assert.Equal(svc.ChooseServer(key).ID, servedBy(ctx, client, key, ids), key)
+	}
+
+	// the addresses follow the service
+	bk.h.OnDelete("/test/greeter/2")
+	assert.Eventually(func() bool {
+		for i := 0; i < 20; i++ {
+			if servedBy(ctx, client, fmt.Sprintf("user-%d", i), ids) == "2" {
+				return false
+			}
+		}
+		return true
+	}, 3*time.Second, 50*time.Millisecond)
+
+	// the calls without hash key are spread, only the ones reaching server 1 succeed
+	succeeded := 0
+	for i := 0; i < 10; i++ {
+		if _, err := client.Check(ctx, &healthpb.HealthCheckRequest{Service: "1"}); err == nil {
+			succeeded++
+		}
+	}
+	assert.Greater(succeeded, 0)
+	assert.Less(succeeded, 10)
+
+	_, err = grpclib.Dial("xdisco:///unknown", grpclib.WithTransportCredentials(insecure.NewCredentials()))
+	assert.Error(err)
+}
+
+func TestResolver_BeforeStart(t *testing.T) {
+	assert := assert.New(t)
+	bk := &fakeBroker{}
+	svc := xdisco.NewService("lazy", bk, health.Custom(func(*server.Server) error { return nil }))
+	b := NewBuilder()
+	b.AddService(svc)
+
+	// dialed before the service is initialized
+	conn, err := grpclib.Dial("xdisco:///lazy?port=grpc",
+		grpclib.WithTransportCredentials(insecure.NewCredentials()),
+		grpclib.WithResolvers(b))
+	if !assert.NoError(err) {
+		return
+	}
+	defer conn.Close()
+	client := healthpb.NewHealthClient(conn)
+	ctx, cancel := context.WithTimeout(context.TODO(), 100*time.Millisecond)
+	defer cancel()
+	_, err = client.Check(ctx, &healthpb.HealthCheckRequest{Service: "1"})
+	assert.Error(err)
+
+	s := startServer(t, "1")
+	s.Kind = "lazy"
+	bk.servers = []*server.Server{s}
+	assert.NoError(svc.Start(context.TODO()))
+	assert.Eventually(func() bool {
+		ctx, cancel := context.WithTimeout(context.TODO(), time.Second)
+		defer cancel()
+		_, err := client.Check(ctx, &healthpb.HealthCheckRequest{Service: "1"})
+		return err == nil
+	}, 3*time.Second, 50*time.Millisecond)
+}
@@ -0,0 +1,157 @@
+package grpc
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/cupen/xdisco"
+	"github.com/cupen/xdisco/logs"
+	"github.com/cupen/xdisco/server"
+	"google.golang.org/grpc/attributes"
+	"google.golang.org/grpc/resolver"
+)
+
+var (
+	log  = logs.Logger("info")
+	log2 = log.Sugar()
+)
+
+// Scheme of the targets resolved with the servers of a kind, such as xdisco:///kind?port=grpc.
+const Scheme = "xdisco"
+
+// the port of the servers dialed if the target gives none
+const defaultPort = "grpc"
+
+// attribute of the addresses holding the ID of the server
+type idKey struct{}
+
+var defaultBuilder = NewBuilder()
+
+func init() {
+	resolver.Register(defaultBuilder)
+}
+
+// Register makes the servers of svc resolvable by the targets of its kind.
+func Register(svc *xdisco.Service) {
+	defaultBuilder.AddService(svc)
+}
+
+// Builder resolves the targets of a kind with the servers of the Service of the kind.
+type Builder struct {
+	mu        sync.Mutex
+	services  map[string]*xdisco.Service
+	removes   map[string]func() // removes the change callback of the service of the kind
+	resolvers map[string]map[*xdiscoResolver]struct{}
+}
+
+func NewBuilder() *Builder {
+	return &Builder{
+		services:  map[string]*xdisco.Service{},
+		removes:   map[string]func(){},
+		resolvers: map[string]map[*xdiscoResolver]struct{}{},
+	}
+}
+
+// AddService makes the servers of svc resolvable, the changes are pushed to the resolvers of the kind.
+// It replaces the service added before for the kind.
+func (b *Builder) AddService(svc *xdisco.Service) {
+	kind := svc.Kind()
+	remove := svc.AddOnChanged(func(svc *xdisco.Service) {
+		b.mu.Lock()
+		resolvers := make([]*xdiscoResolver, 0, len(b.resolvers[kind]))
+		for r := range b.resolvers[kind] {
+			resolvers = append(resolvers, r)
+		}
+		b.mu.Unlock()
+		servers := svc.GetServerList().GetAll()
+		for _, r := range resolvers {
+			r.update(servers)
+		}
+	})
+	b.mu.Lock()
+	b.services[kind] = svc
+	replaced := b.removes[kind]
+	b.removes[kind] = remove
+	b.mu.Unlock()
+	if replaced != nil {
+		replaced()
+	}
+}
+
+func (b *Builder) Scheme() string {
+	return Scheme
+}
+
+func (b *Builder) Build(target resolver.Target, cc resolver.ClientConn, opts resolver.BuildOptions) (resolver.Resolver, error) {
+	kind := target.Endpoint()
+	port := target.URL.Query().Get("port")
+	if port == "" {
+		port = defaultPort
+	}
+	b.mu.Lock()
+	svc, ok := b.services[kind]
+	if !ok {
+		b.mu.Unlock()
+		return nil, fmt.Errorf("no service of kind: %s", kind)
+	}
+	r := &xdiscoResolver{b: b, kind: kind, port: port, svc: svc, cc: cc}
+	if b.resolvers[kind] == nil {
+		b.resolvers[kind] = map[*xdiscoResolver]struct{}{}
+	}
+	b.resolvers[kind][r] = struct{}{}
+	b.mu.Unlock()
+	r.ResolveNow(resolver.ResolveNowOptions{})
+	return r, nil
+}
+
+func (b *Builder) remove(r *xdiscoResolver) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delete(b.resolvers[r.kind], r)
+}
+
+type xdiscoResolver struct {
+	b    *Builder
+	kind string
+	port string
+	svc  *xdisco.Service
+	// serializes the updates of cc
+	mu sync.Mutex
+	cc resolver.ClientConn
+}
+
+func (r *xdiscoResolver) update(servers []*server.Server) {
+	addrs := make([]resolver.Address, 0, len(servers))
+	for _, s := range servers {
+		if _, ok := s.Ports[r.port]; !ok {
+			continue
+		}
+		addrs = append(addrs, resolver.Address{
+			Addr:               s.PrivateAddress(r.port),
+			BalancerAttributes: attributes.New(idKey{}, s.ID),
+		})
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(addrs) <= 0 {
+		r.cc.ReportError(fmt.Errorf("no server of kind %s with port %s", r.kind, r.port))
+		return
+	}
+	if err := r.cc.UpdateState(resolver.State{Addresses: addrs}); err != nil {
+		log2.Warnf("[grpc] update addresses failed. kind=%s err:%v", r.kind, err)
+	}
+}
+
+func (r *xdiscoResolver) ResolveNow(resolver.ResolveNowOptions) {
+	r.update(r.svc.GetServerList().GetAll())
+}
+
+func (r *xdiscoResolver) Close() {
+	r.b.remove(r)
+}
+
+// serverID returns the ID of the server of addr.
+func serverID(addr resolver.Address) string {
+	id, _ := addr.BalancerAttributes.Value(idKey{}).(string)
+	return id
+}
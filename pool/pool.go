@@ -0,0 +1,261 @@
+package pool
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/cupen/xdisco"
+	"github.com/cupen/xdisco/logs"
+	"github.com/cupen/xdisco/server"
+)
+
+var (
+	log  = logs.Logger("info")
+	log2 = log.Sugar()
+)
+
+var (
+	// ErrNoServer means no server is chosen for the key.
+	ErrNoServer = errors.New("no server found")
+	// ErrClosed means the pool is closed.
+	ErrClosed = errors.New("pool closed")
+)
+
+// Dial opens a connection to the server.
+type Dial func(*server.Server) (io.Closer, error)
+
+type Options struct {
+	// minimum interval between two dials of a server, failed dials are retried in the background with it
+	RetryInterval time.Duration `json:"retryInterval" toml:"retryInterval"`
+}
+
+func DefaultOptions() *Options {
+	return &Options{
+		RetryInterval: 3 * time.Second,
+	}
+}
+
+func (c *Options) WithDefault() *Options {
+	defaultOptions := DefaultOptions()
+	if c.RetryInterval <= 0 {
+		c.RetryInterval = defaultOptions.RetryInterval
+	}
+	return c
+}
+
+// Pool keeps a connection to every server of a Service:
+// it dials the servers found and closes the connections of the servers removed or unhealthy.
+type Pool struct {
+	svc  *xdisco.Service
+	dial Dial
+	opts *Options
+
+	mu     sync.Mutex
+	conns  map[string]*entry
+	closed bool
+}
+
+// entry is the connection to a server, being dialed until ready is closed.
+type entry struct {
+	s      *server.Server
+	ready  chan struct{}
+	conn   io.Closer
+	err    error
+	dialAt time.Time
+}
+
+func (e *entry) done() bool {
+	select {
+	case <-e.ready:
+		return true
+	default:
+		return false
+	}
+}
+
+func New(svc *xdisco.Service, dial Dial, opts *Options) *Pool {
+	return &Pool{
+		svc:   svc,
+		dial:  dial,
+		opts:  opts.WithDefault(),
+		conns: map[string]*entry{},
+	}
+}
+
+func keyOf(s *server.Server) string {
+	if key := s.GetKey(); key != "" {
+		return key
+	}
+	return s.ID
+}
+
+// Start keeps the connections along with the servers of the Service until ctx is done, then closes them.
+func (p *Pool) Start(ctx context.Context) {
+	remove := p.svc.AddOnChanged(func(svc *xdisco.Service) {
+		p.Update(svc.GetServerList().GetAll())
+	})
+	p.Update(p.svc.GetServerList().GetAll())
+	go func() {
+		ticker := time.NewTicker(p.opts.RetryInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				p.retry()
+			case <-ctx.Done():
+				remove()
+				p.Close()
+				return
+			}
+		}
+	}()
+}
+
+// Update dials the servers new to the pool, and closes the connections of the servers absent from servers.
+// A server is dialed again if its address changes.
+func (p *Pool) Update(servers []*server.Server) {
+	current := map[string]*server.Server{}
+	for _, s := range servers {
+		current[keyOf(s)] = s
+	}
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return
+	}
+	removed := []*entry{}
+	for key, e := range p.conns {
+		if s, ok := current[key]; !ok || !sameAddress(s, e.s) {
+			delete(p.conns, key)
+			removed = append(removed, e)
+		}
+	}
+	for key, s := range current {
+		if _, ok := p.conns[key]; !ok {
+			p.connect(key, s)
+		}
+	}
+	p.mu.Unlock()
+	for _, e := range removed {
+		log2.Infof("[pool] server removed. key=%s", keyOf(e.s))
+		p.release(e)
+	}
+}
+
+func sameAddress(a, b *server.Server) bool {
+	return a.Host == b.Host && reflect.DeepEqual(a.Ports, b.Ports)
+}
+
+// connect dials s in the background, p.mu must be held.
+func (p *Pool) connect(key string, s *server.Server) *entry {
+	e := &entry{s: s, ready: make(chan struct{}), dialAt: time.Now()}
+	p.conns[key] = e
+	go func() {
+		conn, err := p.dial(s)
+		if err != nil {
+			log2.Warnf("[pool] dial failed. key=%s err:%v", key, err)
+		}
+		p.mu.Lock()
+		e.conn, e.err = conn, err
+		stale := p.conns[key] != e
+		p.mu.Unlock()
+		close(e.ready)
+		if stale && conn != nil {
+			conn.Close()
+		}
+	}()
+	return e
+}
+
+// release closes the connection of e once it is dialed.
+func (p *Pool) release(e *entry) {
+	go func() {
+		<-e.ready
+		p.mu.Lock()
+		conn := e.conn
+		p.mu.Unlock()
+		if conn != nil {
+			conn.Close()
+		}
+	}()
+}
+
+// retry dials the servers failed to dial again.
+func (p *Pool) retry() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for key, e := range p.conns {
+		if e.done() && e.err != nil && time.Since(e.dialAt) >= p.opts.RetryInterval {
+			p.connect(key, e.s)
+		}
+	}
+}
+
+// Get returns the connection to the server chosen for key by the Service,
+// it waits for the dial in progress and dials again a server failed before.
+func (p *Pool) Get(key string) (io.Closer, error) {
+	s := p.svc.ChooseServer(key)
+	if s == nil {
+		return nil, ErrNoServer
+	}
+	return p.GetServer(s)
+}
+
+// GetServer returns the connection to s.
+func (p *Pool) GetServer(s *server.Server) (io.Closer, error) {
+	key := keyOf(s)
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return nil, ErrClosed
+	}
+	e, ok := p.conns[key]
+	if !ok || (e.done() && e.err != nil && time.Since(e.dialAt) >= p.opts.RetryInterval) {
+		e = p.connect(key, s)
+	}
+	p.mu.Unlock()
+	<-e.ready
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if e.err != nil {
+		return nil, fmt.Errorf("dial %s failed. %w", key, e.err)
+	}
+	return e.conn, nil
+}
+
+// Invalidate closes a broken connection got from the pool, the server is dialed again.
+func (p *Pool) Invalidate(conn io.Closer) {
+	p.mu.Lock()
+	var found *entry
+	for key, e := range p.conns {
+		if e.done() && e.conn == conn {
+			found = e
+			if !p.closed {
+				p.connect(key, e.s)
+			}
+			break
+		}
+	}
+	p.mu.Unlock()
+	if found != nil {
+		log2.Infof("[pool] connection invalidated. key=%s", keyOf(found.s))
+	}
+	conn.Close()
+}
+
+// Close closes all the connections, Get fails with ErrClosed afterwards.
+func (p *Pool) Close() {
+	p.mu.Lock()
+	conns := p.conns
+	p.conns = map[string]*entry{}
+	p.closed = true
+	p.mu.Unlock()
+	for _, e := range conns {
+		p.release(e)
+	}
+}
@@ -0,0 +1,163 @@
+package pool
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cupen/xdisco"
+	"github.com/cupen/xdisco/broker"
+	"github.com/cupen/xdisco/eventhandler"
+	"github.com/cupen/xdisco/health"
+	"github.com/cupen/xdisco/server"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeBroker emits the events of the servers set by the test.
+type fakeBroker struct {
+	broker.Broker
+	servers []*server.Server
+	h       eventhandler.Handler
+}
+
+func (b *fakeBroker) Watch(ctx context.Context, kind string, h eventhandler.Handler, hc server.Checker) error {
+	b.h = h
+	h.OnInit(b.servers)
+	return nil
+}
+
+type fakeConn struct {
+	mu     sync.Mutex
+	s      *server.Server
+	closed bool
+}
+
+func (c *fakeConn) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.closed = true
+	return nil
+}
+
+func (c *fakeConn) isClosed() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.closed
+}
+
+func newServer(id, host string) *server.Server {
+	s := server.NewServer(id, "test", host)
+	s.SetKey("/test/" + id)
+	return s
+}
+
+func TestPool(t *testing.T) {
+	assert := assert.New(t)
+	bk := &fakeBroker{servers: []*server.Server{newServer("1", "10.0.0.1")}}
+	svc := xdisco.NewService("test", bk, health.Custom(func(*server.Server) error { return nil }))
+	assert.NoError(svc.Start(context.TODO()))
+
+	var mu sync.Mutex
+	dials := map[string]int{}
+	failing := map[string]bool{"2": true}
+	dial := func(s *server.Server) (io.Closer, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		dials[s.ID]++
+		if failing[s.ID] {
+			return nil, errors.New("refused")
+		}
+		return &fakeConn{s: s}, nil
+	}
+	ctx, cancel := context.WithCancel(context.TODO())
+	defer cancel()
+	p := New(svc, dial, &Options{RetryInterval: 50 * time.Millisecond})
+	p.Start(ctx)
+
+	conn, err := p.Get("user-1")
+	if !assert.NoError(err) {
+		return
+	}
+	c1 := conn.(*fakeConn)
+	assert.Equal("1", c1.s.ID)
+
+	// a server failing to dial is retried
+	bk.h.OnAdd("/test/2", newServer("2", "10.0.0.2"))
+	_, err = p.GetServer(newServer("2", "10.0.0.2"))
+	assert.Error(err)
+	mu.Lock()
+	failing["2"] = false
+	mu.Unlock()
+	assert.Eventually(func() bool {
+		_, err := p.GetServer(newServer("2", "10.0.0.2"))
+		return err == nil
+	}, time.Second, 10*time.Millisecond)
+
+	// a broken connection is dialed again
+	p.Invalidate(c1)
+	assert.True(c1.isClosed())
+	conn, err = p.GetServer(newServer("1", "10.0.0.1"))
+	assert.NoError(err)
+	assert.NotSame(c1, conn)
+	mu.Lock()
+	assert.Equal(2, dials["1"])
+	mu.Unlock()
+
+	// closed on removal
+	bk.h.OnDelete("/test/1")
+	c2 := conn.(*fakeConn)
+	assert.Eventually(c2.isClosed, time.Second, 10*time.Millisecond)
+
+	_, err = p.Get("user-1")
+	assert.NoError(err)
+	cancel()
+	assert.Eventually(func() bool {
+		_, err := p.Get("user-1")
+		return errors.Is(err, ErrClosed)
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestPool_Unhealthy(t *testing.T) {
+	assert := assert.New(t)
+	bk := &fakeBroker{servers: []*server.Server{newServer("1", "10.0.0.1"), newServer("2", "10.0.0.2")}}
+	var mu sync.Mutex
+	unhealthy := map[string]bool{}
+	checker := health.Custom(func(s *server.Server) error {
+		mu.Lock()
+		defer mu.Unlock()
+		if unhealthy[s.ID] {
+			return errors.New("unhealthy")
+		}
+		return nil
+	})
+	svc := xdisco.NewService("test", bk, checker)
+	ctx, cancel := context.WithCancel(context.TODO())
+	defer cancel()
+	p := New(svc, func(s *server.Server) (io.Closer, error) { return &fakeConn{s: s}, nil }, DefaultOptions())
+
+	// started before the service is initialized
+	p.Start(ctx)
+	_, err := p.Get("user-1")
+	assert.ErrorIs(err, ErrNoServer)
+	assert.NoError(svc.Start(context.TODO()))
+	conn, err := p.GetServer(newServer("2", "10.0.0.2"))
+	assert.NoError(err)
+
+	// a server failing the checker is dropped and its connection closed
+	mu.Lock()
+	unhealthy["2"] = true
+	mu.Unlock()
+	bk.h.OnUpdate("/test/2", newServer("2", "10.0.0.2"))
+	assert.Eventually(conn.(*fakeConn).isClosed, time.Second, 10*time.Millisecond)
+	assert.Len(svc.GetServerList().GetAll(), 1)
+	for i := 0; i < 10; i++ {
+		conn, err := p.Get(fmt.Sprintf("user-%d", i))
+		if assert.NoError(err) {
+			assert.Equal("1", conn.(*fakeConn).s.ID)
+		}
+	}
+}
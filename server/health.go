@@ -0,0 +1,7 @@
+package server
+
+// Health is the readiness published by a server, distinct from its lifecycle State.
+type Health struct {
+	OK     bool   `json:"ok"`
+	Reason string `json:"reason,omitempty"`
+}
@@ -0,0 +1,31 @@
+package server
+
+// Load is the load published by a server.
+// Score is a custom metric, lower values are less loaded. A server reporting it ranks before one that does not.
+type Load struct {
+	Connections int     `json:"connections,omitempty"`
+	CPU         float64 `json:"cpu,omitempty"`
+	Score       float64 `json:"score,omitempty"`
+}
+
+// Less reports whether l is less loaded than other.
+// A nil Load is unknown and never less loaded than a reported one.
+func (l *Load) Less(other *Load) bool {
+	if l == nil {
+		return false
+	}
+	if other == nil {
+		return true
+	}
+	// an unset Score is unknown rather than zero, so rank the scored ones first to keep the order total.
+	if (l.Score != 0) != (other.Score != 0) {
+		return l.Score != 0
+	}
+	if l.Score != other.Score {
+		return l.Score < other.Score
+	}
+	if l.Connections != other.Connections {
+		return l.Connections < other.Connections
+	}
+	return l.CPU < other.CPU
+}
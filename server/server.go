@@ -20,6 +20,8 @@ type Server struct {
 	Annotations map[string]string `json:"annotations"`
 	Status      string            `json:"status"`
 	Weight      int               `json:"weight"`
+	Health      *Health           `json:"health,omitempty"`
+	Load        *Load             `json:"load,omitempty"`
 	UpdatedAt   time.Time         `json:"updatedAt"`
 	CreatedAt   time.Time         `json:"createdAt"`
 	key         string            `json:"-"`
@@ -59,6 +61,34 @@ func NewServerFromEtcd(key string, data []byte) (*Server, error) {
 	return &s, nil
 }
 
+// Clone returns a deep copy of the server.
+func (s *Server) Clone() *Server {
+	c := *s
+	c.Ports = cloneMap(s.Ports)
+	c.Labels = cloneMap(s.Labels)
+	c.Annotations = cloneMap(s.Annotations)
+	if s.Health != nil {
+		h := *s.Health
+		c.Health = &h
+	}
+	if s.Load != nil {
+		l := *s.Load
+		c.Load = &l
+	}
+	return &c
+}
+
+func cloneMap[V any](m map[string]V) map[string]V {
+	if m == nil {
+		return nil
+	}
+	rs := make(map[string]V, len(m))
+	for k, v := range m {
+		rs[k] = v
+	}
+	return rs
+}
+
 func (s *Server) GetID() string {
 	return s.ID
 }
@@ -112,6 +142,21 @@ func (s *Server) GetStatus() State {
 	return State(s.Status)
 }
 
+// SetHealth records the readiness reported by the server itself.
+func (s *Server) SetHealth(ok bool, reason string) {
+	s.Health = &Health{OK: ok, Reason: reason}
+}
+
+// IsReady reports whether the server considers itself ready.
+// Servers that never reported their health are treated as ready.
+func (s *Server) IsReady() bool {
+	return s.Health == nil || s.Health.OK
+}
+
+func (s *Server) SetLoad(load Load) {
+	s.Load = &load
+}
+
 func (s *Server) SetAnnotation(name, value string) {
 	if s.Annotations == nil {
 		s.Annotations = map[string]string{}
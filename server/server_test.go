@@ -0,0 +1,29 @@
+package server
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHealth(t *testing.T) {
+	assert := assert.New(t)
+	s := NewServer("1", "test", "127.0.0.1")
+	assert.True(s.IsReady())
+
+	s.SetHealth(false, "warming up")
+	assert.False(s.IsReady())
+
+	data, err := json.Marshal(s)
+	assert.NoError(err)
+	s2, err := NewServerFromEtcd("/test/1", data)
+	assert.NoError(err)
+	assert.False(s2.IsReady())
+	assert.Equal("warming up", s2.Health.Reason)
+
+	// records written before health reporting existed
+	s3, err := NewServerFromEtcd("/test/1", []byte(`{"id":"1","kind":"test"}`))
+	assert.NoError(err)
+	assert.True(s3.IsReady())
+}
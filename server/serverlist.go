@@ -2,6 +2,7 @@ package server
 
 import (
 	"fmt"
+	"math/rand"
 	"strings"
 	"sync"
 
@@ -112,3 +113,87 @@ func (this *ServerList) Lookup(id string) *Server {
 	log2.Infof("lookup server<%s> by id<%s>", serverId, id)
 	return this.Get(serverId)
 }
+
+// LeastLoaded returns the least loaded server accepted by filter, nil filter accepts all.
+func (this *ServerList) LeastLoaded(filter func(*Server) bool) *Server {
+	var rs *Server
+	for _, s := range this.serverList {
+		if filter != nil && !filter(s) {
+			continue
+		}
+		if rs == nil || s.Load.Less(rs.Load) {
+			rs = s
+		}
+	}
+	return rs
+}
+
+// P2C picks two random servers accepted by filter and returns the less loaded one,
+// it spreads new work without sending everything to the same server between load reports.
+func (this *ServerList) P2C(filter func(*Server) bool) *Server {
+	candidates := this.serverList
+	if filter != nil {
+		candidates = []*Server{}
+		for _, s := range this.serverList {
+			if filter(s) {
+				candidates = append(candidates, s)
+			}
+		}
+	}
+	switch len(candidates) {
+	case 0:
+		return nil
+	case 1:
+		return candidates[0]
+	}
+	i := rand.Intn(len(candidates))
+	j := rand.Intn(len(candidates) - 1)
+	if j >= i {
+		j++
+	}
+	a, b := candidates[i], candidates[j]
+	if b.Load.Less(a.Load) {
+		return b
+	}
+	return a
+}
+
+// Move is a key looked up on another server after the server list changes.
+type Move struct {
+	Key string
+	// ID of the server owning the key before, empty if there was none
+	From string
+	// ID of the server owning the key now, empty if there is none
+	To string
+}
+
+// Moved returns the keys which Lookup maps to another server than it did on old,
+// keys may be the keys held by the caller or a sample of the keyspace.
+func (this *ServerList) Moved(old *ServerList, keys []string) []Move {
+	if old != nil && this.sameMembers(old) {
+		return nil
+	}
+	moves := []Move{}
+	for _, key := range keys {
+		from := ""
+		if old != nil {
+			from = old.chash.Get(key)
+		}
+		if to := this.chash.Get(key); to != from {
+			moves = append(moves, Move{Key: key, From: from, To: to})
+		}
+	}
+	return moves
+}
+
+func (this *ServerList) sameMembers(other *ServerList) bool {
+	if len(this.serverMap) != len(other.serverMap) {
+		return false
+	}
+	for sid := range this.serverMap {
+		if !other.Has(sid) {
+			return false
+		}
+	}
+	return true
+}
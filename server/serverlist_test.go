@@ -38,3 +38,106 @@ func TestServer(_t *testing.T) {
 		assert.Equal(newList(10), obj.GetAll())
 	})
 }
+
+func TestLeastLoaded(t *testing.T) {
+	assert := assert.New(t)
+	newServer := func(id string, load *Load) *Server {
+		s := NewServer(id, "test", "127.0.0.1")
+		s.Load = load
+		s.Labels["map"] = "v1"
+		return s
+	}
+	list := NewServerList([]*Server{
+		newServer("0", nil),
+		newServer("1", &Load{Connections: 10}),
+		newServer("2", &Load{Connections: 3}),
+		newServer("3", &Load{Connections: 5, Score: 1}),
+		newServer("4", &Load{Connections: 8, Score: 0.5}),
+	})
+	list.Get("3").Labels["map"] = "v2"
+
+	assert.Equal("4", list.LeastLoaded(nil).ID)
+	assert.Equal("3", list.LeastLoaded(func(s *Server) bool {
+		return s.GetLabel("map") == "v2"
+	}).ID)
+	assert.Nil(list.LeastLoaded(func(s *Server) bool { return false }))
+	// a scored server ranks before an unscored one whatever the connections.
+	assert.Equal("4", list.LeastLoaded(func(s *Server) bool { return s.ID == "3" || s.ID == "4" }).ID)
+	assert.Equal("3", list.LeastLoaded(func(s *Server) bool { return s.ID == "1" || s.ID == "3" }).ID)
+	assert.Equal("4", list.LeastLoaded(func(s *Server) bool { return s.ID == "2" || s.ID == "4" }).ID)
+
+	for i := 0; i < 100; i++ {
+		s := list.P2C(func(s *Server) bool { return s.ID != "0" && s.ID != "4" })
+		assert.NotEqual("1", s.ID)
+	}
+	assert.Equal("1", list.P2C(func(s *Server) bool { return s.ID == "1" }).ID)
+	assert.Nil(NewServerList(nil).P2C(nil))
+}
+
+func TestLeastLoaded_Order(t *testing.T) {
+	newServer := func(id string, load *Load) *Server {
+		s := NewServer(id, "test", "127.0.0.1")
+		s.Load = load
+		return s
+	}
+	a := newServer("a", &Load{Connections: 3, Score: 1})
+	b := newServer("b", &Load{Connections: 1, Score: 2})
+	c := newServer("c", &Load{Connections: 2})
+	cases := []struct {
+		name    string
+		servers []*Server
+	}{
+		{"abc", []*Server{a, b, c}},
+		{"acb", []*Server{a, c, b}},
+		{"bac", []*Server{b, a, c}},
+		{"bca", []*Server{b, c, a}},
+		{"cab", []*Server{c, a, b}},
+		{"cba", []*Server{c, b, a}},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			assert := assert.New(t)
+			list := NewServerList(c.servers)
+			assert.Equal("a", list.LeastLoaded(nil).ID)
+			assert.Equal("b", list.LeastLoaded(func(s *Server) bool { return s.ID != "a" }).ID)
+		})
+	}
+}
+
+func TestMoved(t *testing.T) {
+	assert := assert.New(t)
+	newServers := func(ids ...string) *ServerList {
+		list := []*Server{}
+		for _, id := range ids {
+			s := NewServer(id, "test", "127.0.0.1")
+			s.SetKey("/test/" + id)
+			list = append(list, s)
+		}
+		return NewServerList(list)
+	}
+	keys := []string{}
+	for i := 0; i < 1000; i++ {
+		keys = append(keys, fmt.Sprintf("session-%d", i))
+	}
+	old := newServers("1", "2", "3")
+	assert.Empty(newServers("3", "2", "1").Moved(old, keys))
+
+	// only the keys of the server gone move
+	moves := newServers("1", "3").Moved(old, keys)
+	assert.NotEmpty(moves)
+	for _, m := range moves {
+		assert.Equal("2", m.From)
+		assert.Equal(m.To, newServers("1", "3").Lookup(m.Key).ID)
+	}
+
+	// only the keys taken by the server joining move
+	moves = newServers("1", "2", "3", "4").Moved(old, keys)
+	assert.NotEmpty(moves)
+	for _, m := range moves {
+		assert.Equal("4", m.To)
+	}
+
+	moves = newServers().Moved(old, keys[:3])
+	assert.Len(moves, 3)
+	assert.Equal("", moves[0].To)
+}
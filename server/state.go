@@ -11,3 +11,9 @@ var States = struct {
 	Stopping: "stopping",
 	Stopped:  "stopped",
 }
+
+// IsStopping reports whether a server in this state is leaving and
+// should not be given new work.
+func (s State) IsStopping() bool {
+	return s == States.Stopping || s == States.Stopped
+}
@@ -20,7 +20,15 @@ type Service struct {
 	unhealths atomic.Value // ServerList Unhealth
 	broker    broker.Broker
 	checker   server.Checker
-	onChanged func(*Service)
+
+	// callbacks of the changes, see OnChanged and AddOnChanged
+	changedMu   sync.Mutex
+	onChanged   func(*Service)
+	subscribers []*subscriber
+
+	// keys checked for moves and the callback of the moves, see OnKeysMoved, guarded by changedMu
+	movedKeys func() []string
+	onMoved   func([]server.Move)
 
 	logPrefix string
 }
@@ -66,16 +74,72 @@ func (this *Service) Handler() eventhandler.Handler {
 }
 
 func (this *Service) OnChanged(callback func(*Service)) {
+	this.changedMu.Lock()
+	defer this.changedMu.Unlock()
 	this.onChanged = callback
 }
 
+// subscriber is a callback added by AddOnChanged.
+type subscriber struct {
+	callback func(*Service)
+}
+
+// AddOnChanged adds a callback invoked whenever the servers change, after the one set by OnChanged,
+// so several components follow the same service. The returned func removes the callback.
+func (this *Service) AddOnChanged(callback func(*Service)) (remove func()) {
+	this.changedMu.Lock()
+	defer this.changedMu.Unlock()
+	added := &subscriber{callback: callback}
+	this.subscribers = append(this.subscribers, added)
+	return func() {
+		this.changedMu.Lock()
+		defer this.changedMu.Unlock()
+		for i, sub := range this.subscribers {
+			if sub == added {
+				this.subscribers = append(this.subscribers[:i:i], this.subscribers[i+1:]...)
+				return
+			}
+		}
+	}
+}
+
+func (this *Service) notifyChanged() {
+	this.changedMu.Lock()
+	onChanged, subscribers := this.onChanged, this.subscribers
+	this.changedMu.Unlock()
+	if onChanged != nil {
+		onChanged(this)
+	}
+	for _, sub := range subscribers {
+		sub.callback(this)
+	}
+}
+
+// OnKeysMoved sets the callback invoked with the keys which ChooseServer maps to another server
+// whenever the servers change, keys returns the keys to check, such as the sessions held by the caller.
+func (this *Service) OnKeysMoved(keys func() []string, callback func([]server.Move)) {
+	this.changedMu.Lock()
+	defer this.changedMu.Unlock()
+	this.movedKeys = keys
+	this.onMoved = callback
+}
+
 func (this *Service) ChooseServer(id string) *server.Server {
 	servers := this.GetServerList()
 	return servers.Lookup(id)
 }
 
+// ChooseLeastLoaded returns the least loaded server accepted by filter.
+func (this *Service) ChooseLeastLoaded(filter func(*server.Server) bool) *server.Server {
+	return this.GetServerList().LeastLoaded(filter)
+}
+
+// GetServerList returns the healthy servers, empty until the broker initializes the service.
 func (this *Service) GetServerList() *server.ServerList {
-	servers := this.healths.Load().(*server.ServerList)
+	servers, ok := this.healths.Load().(*server.ServerList)
+	if !ok {
+		return server.NewServerList(nil)
+	}
 	return servers
 }
 
@@ -88,20 +152,36 @@ func (this *Service) buildServerList(list []*server.Server) {
 
 func (this *Service) renewServers() {
 	serverlist := server.NewServerListFromMap(&this.m)
-	this.healths.Store(serverlist)
+	old := this.healths.Swap(serverlist)
+	this.changedMu.Lock()
+	movedKeys, onMoved := this.movedKeys, this.onMoved
+	this.changedMu.Unlock()
+	if old != nil && onMoved != nil {
+		moves := serverlist.Moved(old.(*server.ServerList), movedKeys())
+		if len(moves) > 0 {
+			log2.Infof("server<%s> keys moved: %d", this.kind, len(moves))
+			onMoved(moves)
+		}
+	}
 }
 
 func (this *Service) onServersInit(servers []*server.Server) {
-	alives, dead := server.Filter(servers, this.checker)
+	readies := make([]*server.Server, 0, len(servers))
+	for _, s := range servers {
+		if ok, reason := isRoutable(s); !ok {
+			log2.Infof("server<%s> not ready: %s reason:%s", s.Kind, s.GetKey(), reason)
+			continue
+		}
+		readies = append(readies, s)
+	}
+	alives, dead := server.Filter(readies, this.checker)
 	for _, s := range alives {
 		key := s.GetKey()
 		this.m.Store(key, s)
 		log2.Infof("server<%s> initialized: %s", s.Kind, key)
 	}
 	this.renewServers()
-	if this.onChanged != nil {
-		this.onChanged(this)
-	}
+	this.notifyChanged()
 	for _, s := range dead {
 		key := s.GetKey()
 		this.onServerUnhealth(key, s)
@@ -111,6 +191,10 @@ func (this *Service) onServersInit(servers []*server.Server) {
 
 func (this *Service) onServerAdd(key string, s *server.Server) {
 	now := time.Now()
+	if ok, reason := isRoutable(s); !ok {
+		this.onServerUnready(key, s, reason)
+		return
+	}
 	if err := s.Check(this.checker); err != nil {
 		log2.Warnf("server<%s> unhealth: %s reason:%v", key, err)
 		this.onServerUnhealth(key, s)
@@ -119,13 +203,15 @@ func (this *Service) onServerAdd(key string, s *server.Server) {
 	this.m.Store(key, s)
 	this.renewServers()
 	log2.Infof("server<%s> found  : %s  cost: %v", s.Kind, key, time.Since(now))
-	if this.onChanged != nil {
-		this.onChanged(this)
-	}
+	this.notifyChanged()
 }
 
 func (this *Service) onServerUpdate(key string, s *server.Server) {
 	now := time.Now()
+	if ok, reason := isRoutable(s); !ok {
+		this.onServerUnready(key, s, reason)
+		return
+	}
 	if err := s.Check(this.checker); err != nil {
 		log2.Warnf("server<%s> unhealth: %s err: %s", s.Kind, key, err)
 		this.onServerUnhealth(key, s)
@@ -134,9 +220,7 @@ func (this *Service) onServerUpdate(key string, s *server.Server) {
 	this.m.Store(key, s)
 	this.renewServers()
 	log2.Debugf("server<%s> alives: %s  cost: %v", s.Kind, key, time.Since(now))
-	if this.onChanged != nil {
-		this.onChanged(this)
-	}
+	this.notifyChanged()
 }
 
 func (this *Service) onServerDelete(key string) {
@@ -144,13 +228,39 @@ func (this *Service) onServerDelete(key string) {
 	this.m.Delete(key)
 	this.renewServers()
 	log2.Infof("server<%s> deleted: %s  cost: %v", this.kind, key, time.Since(now))
-	if this.onChanged != nil {
-		this.onChanged(this)
+	this.notifyChanged()
+}
+
+// isRoutable reports whether s accepts new work according to what it published itself.
+func isRoutable(s *server.Server) (bool, string) {
+	if s.GetStatus().IsStopping() {
+		return false, s.Status
 	}
+	if !s.IsReady() {
+		return false, s.Health.Reason
+	}
+	return true, ""
 }
 
-func (this *Service) onServerUnhealth(key string, s *server.Server) {
+// onServerUnready drops a server that reported itself as not ready, without probing it.
+func (this *Service) onServerUnready(key string, s *server.Server, reason string) {
+	if _, loaded := this.m.LoadAndDelete(key); !loaded {
+		log2.Infof("server<%s> not ready: %s reason:%s", s.Kind, key, reason)
+		return
+	}
+	this.renewServers()
+	log2.Infof("server<%s> removed: %s not ready, reason:%s", s.Kind, key, reason)
+	this.notifyChanged()
+}
 
+// onServerUnhealth drops a server failing the health checker.
+func (this *Service) onServerUnhealth(key string, s *server.Server) {
+	if _, loaded := this.m.LoadAndDelete(key); !loaded {
+		return
+	}
+	this.renewServers()
+	log2.Infof("server<%s> removed: %s unhealth", s.Kind, key)
+	this.notifyChanged()
 }
 
 func (this *Service) CleanUnhealthServer() (deleted int, isChanged bool) {
@@ -165,6 +275,7 @@ func (this *Service) CleanUnhealthServer() (deleted int, isChanged bool) {
 			// this.onServerUnhealth(dead.GetKey(), dead)
 		}
 		this.renewServers()
+		this.notifyChanged()
 
 		// server.Sort(deads)
 		// this.unhealths.Store(server.NewServerList(deads))
@@ -0,0 +1,78 @@
+package xdisco
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/cupen/xdisco/broker"
+	"github.com/cupen/xdisco/eventhandler"
+	"github.com/cupen/xdisco/health"
+	"github.com/cupen/xdisco/server"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeBroker emits the events of the servers set by the test.
+type fakeBroker struct {
+	broker.Broker
+	servers []*server.Server
+	h       eventhandler.Handler
+}
+
+func (b *fakeBroker) Watch(ctx context.Context, kind string, h eventhandler.Handler, hc server.Checker) error {
+	b.h = h
+	h.OnInit(b.servers)
+	return nil
+}
+
+func newServer(id string) *server.Server {
+	s := server.NewServer(id, "test", "127.0.0.1")
+	s.SetKey("/test/" + id)
+	return s
+}
+
+func TestService_AddOnChanged(t *testing.T) {
+	assert := assert.New(t)
+	bk := &fakeBroker{servers: []*server.Server{newServer("1")}}
+	svc := NewService("test", bk, health.Custom(func(*server.Server) error { return nil }))
+	calls := []string{}
+	svc.OnChanged(func(*Service) { calls = append(calls, "set") })
+	svc.AddOnChanged(func(*Service) { calls = append(calls, "a") })
+	removeB := svc.AddOnChanged(func(*Service) { calls = append(calls, "b") })
+	assert.NoError(svc.Start(context.TODO()))
+	assert.Equal([]string{"set", "a", "b"}, calls)
+
+	removeB()
+	removeB()
+	calls = calls[:0]
+	bk.h.OnAdd("/test/2", newServer("2"))
+	assert.Equal([]string{"set", "a"}, calls)
+	assert.Len(svc.GetServerList().GetAll(), 2)
+}
+
+func TestService_CleanUnhealthServer(t *testing.T) {
+	assert := assert.New(t)
+	bk := &fakeBroker{servers: []*server.Server{newServer("1"), newServer("2")}}
+	dead := map[string]bool{}
+	svc := NewService("test", bk, health.Custom(func(s *server.Server) error {
+		if dead[s.ID] {
+			return fmt.Errorf("server %s is dead", s.ID)
+		}
+		return nil
+	}))
+	assert.NoError(svc.Start(context.TODO()))
+	changed := 0
+	svc.AddOnChanged(func(*Service) { changed++ })
+
+	deleted, isChanged := svc.CleanUnhealthServer()
+	assert.Equal(0, deleted)
+	assert.False(isChanged)
+	assert.Equal(0, changed)
+
+	dead["2"] = true
+	deleted, isChanged = svc.CleanUnhealthServer()
+	assert.Equal(1, deleted)
+	assert.True(isChanged)
+	assert.Equal(1, changed)
+	assert.Len(svc.GetServerList().GetAll(), 1)
+}
@@ -0,0 +1,75 @@
+package sharding
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/cupen/xdisco/server"
+)
+
+// AnnotationPartitions is the annotation of a server holding the partitions it owns, written by Publish.
+const AnnotationPartitions = "partitions"
+
+// FormatPartitions formats ascending partitions as ranges, such as "0-3,7,9-12".
+func FormatPartitions(partitions []int) string {
+	var sb strings.Builder
+	for i := 0; i < len(partitions); {
+		j := i
+		for j+1 < len(partitions) && partitions[j+1] == partitions[j]+1 {
+			j++
+		}
+		if sb.Len() > 0 {
+			sb.WriteByte(',')
+		}
+		sb.WriteString(strconv.Itoa(partitions[i]))
+		if j > i {
+			sb.WriteByte('-')
+			sb.WriteString(strconv.Itoa(partitions[j]))
+		}
+		i = j + 1
+	}
+	return sb.String()
+}
+
+// ParsePartitions parses the partitions formatted by FormatPartitions.
+func ParsePartitions(value string) ([]int, error) {
+	partitions := []int{}
+	if value == "" {
+		return partitions, nil
+	}
+	for _, part := range strings.Split(value, ",") {
+		from, to, isRange := strings.Cut(part, "-")
+		start, err := strconv.Atoi(from)
+		if err != nil {
+			return nil, fmt.Errorf("invalid partitions: %s. %w", value, err)
+		}
+		end := start
+		if isRange {
+			if end, err = strconv.Atoi(to); err != nil {
+				return nil, fmt.Errorf("invalid partitions: %s. %w", value, err)
+			}
+		}
+		if start < 0 || end < start {
+			return nil, fmt.Errorf("invalid partitions: %s", value)
+		}
+		for p := start; p <= end; p++ {
+			partitions = append(partitions, p)
+		}
+	}
+	return partitions, nil
+}
+
+// Published returns the partitions published by s, false if it publishes none.
+func Published(s *server.Server) ([]int, bool) {
+	value, ok := s.GetAnnotation(AnnotationPartitions)
+	if !ok {
+		return nil, false
+	}
+	partitions, err := ParsePartitions(value)
+	if err != nil {
+		log2.Warnf("[sharding] invalid partitions published by %s. err:%v", s.GetKey(), err)
+		return nil, false
+	}
+	return partitions, true
+}
@@ -0,0 +1,87 @@
+package sharding
+
+import (
+	"strconv"
+
+	xxhash "github.com/cespare/xxhash/v2"
+	"github.com/cupen/xdisco/lookup"
+	"github.com/cupen/xdisco/server"
+)
+
+// Assignment maps the partitions of a kind to the IDs of the servers owning them.
+// It is computed from the server list alone, so every server of the same list agrees on it.
+type Assignment struct {
+	owners []string
+	owned  map[string][]int
+}
+
+// Assign assigns the partitions across servers with rendezvous hashing,
+// a server joining or leaving moves only the partitions it gains or loses.
+func Assign(partitions int, servers []*server.Server) *Assignment {
+	ids := make([]string, 0, len(servers))
+	for _, s := range servers {
+		ids = append(ids, s.ID)
+	}
+	rdz := lookup.NewRendezvous(ids)
+	a := &Assignment{
+		owners: make([]string, partitions),
+		owned:  map[string][]int{},
+	}
+	for p := 0; p < partitions; p++ {
+		id := rdz.Get(strconv.Itoa(p))
+		a.owners[p] = id
+		if id != "" {
+			a.owned[id] = append(a.owned[id], p)
+		}
+	}
+	return a
+}
+
+// Partitions returns the number of partitions.
+func (a *Assignment) Partitions() int {
+	return len(a.owners)
+}
+
+// Partition returns the partition of key.
+func (a *Assignment) Partition(key string) int {
+	if len(a.owners) <= 0 {
+		return -1
+	}
+	return int(xxhash.Sum64String(key) % uint64(len(a.owners)))
+}
+
+// Owner returns the ID of the server owning the partition, empty if there is none.
+func (a *Assignment) Owner(partition int) string {
+	if partition < 0 || partition >= len(a.owners) {
+		return ""
+	}
+	return a.owners[partition]
+}
+
+// OwnerOf returns the ID of the server owning the partition of key.
+func (a *Assignment) OwnerOf(key string) string {
+	return a.Owner(a.Partition(key))
+}
+
+// PartitionsOf returns the partitions owned by the server in ascending order.
+func (a *Assignment) PartitionsOf(id string) []int {
+	return a.owned[id]
+}
+
+// Diff returns the partitions the server gains and loses from old to a, old may be nil.
+func (a *Assignment) Diff(old *Assignment, id string) (gained, lost []int) {
+	for _, p := range a.PartitionsOf(id) {
+		if old == nil || old.Owner(p) != id {
+			gained = append(gained, p)
+		}
+	}
+	if old == nil {
+		return gained, nil
+	}
+	for _, p := range old.PartitionsOf(id) {
+		if a.Owner(p) != id {
+			lost = append(lost, p)
+		}
+	}
+	return gained, lost
+}
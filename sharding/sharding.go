@@ -0,0 +1,157 @@
+package sharding
+
+import (
+	"sync"
+	"sync/atomic"
+
+	"github.com/cupen/xdisco"
+	"github.com/cupen/xdisco/broker"
+	"github.com/cupen/xdisco/logs"
+	"github.com/cupen/xdisco/server"
+)
+
+var (
+	log  = logs.Logger("info")
+	log2 = log.Sugar()
+)
+
+type Options struct {
+	// number of partitions, every server of the kind must agree on it
+	Partitions int `json:"partitions" toml:"partitions"`
+}
+
+func DefaultOptions() *Options {
+	return &Options{
+		Partitions: 1024,
+	}
+}
+
+func (c *Options) WithDefault() *Options {
+	defaultOptions := DefaultOptions()
+	if c.Partitions <= 0 {
+		c.Partitions = defaultOptions.Partitions
+	}
+	return c
+}
+
+// Handoff is a change of the partitions owned by the server itself.
+type Handoff struct {
+	// partitions to take over
+	Gained []int
+	// partitions to hand over to their new owners
+	Lost []int
+	// the assignment making the change
+	Assignment *Assignment
+}
+
+// Sharding assigns the partitions of a kind across its healthy servers
+// and notifies the server itself of the partitions it gains or loses.
+type Sharding struct {
+	self       string
+	opts       *Options
+	assignment atomic.Value // *Assignment
+
+	// serializes the updates so the handoffs are notified in order
+	mu         sync.Mutex
+	onHandoff  func(Handoff)
+	onAssigned func(*Assignment)
+	published  broker.Registration // the registration of the server itself, see Publish
+}
+
+// New returns the sharding seen by the server of ID self, it owns nothing before the first Update.
+func New(self string, opts *Options) *Sharding {
+	sh := &Sharding{
+		self: self,
+		opts: opts.WithDefault(),
+	}
+	sh.assignment.Store(Assign(sh.opts.Partitions, nil))
+	return sh
+}
+
+// Attach updates the sharding with the servers of svc whenever they change,
+// until the returned func detaches it.
+func (sh *Sharding) Attach(svc *xdisco.Service) (detach func()) {
+	return svc.AddOnChanged(func(svc *xdisco.Service) {
+		sh.Update(svc.GetServerList().GetAll())
+	})
+}
+
+// Publish writes the partitions owned by the server itself to the annotation AnnotationPartitions of reg,
+// now and after every assignment, so operators and the other kinds read the assignment through the broker.
+func (sh *Sharding) Publish(reg broker.Registration) {
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	sh.published = reg
+	sh.publish(sh.Assignment())
+}
+
+func (sh *Sharding) publish(a *Assignment) {
+	if sh.published == nil {
+		return
+	}
+	sh.published.SetAnnotation(AnnotationPartitions, FormatPartitions(a.PartitionsOf(sh.self)))
+}
+
+// Update reassigns the partitions across servers.
+func (sh *Sharding) Update(servers []*server.Server) {
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	old := sh.Assignment()
+	a := Assign(sh.opts.Partitions, servers)
+	if sameOwners(old, a) {
+		return
+	}
+	sh.assignment.Store(a)
+	gained, lost := a.Diff(old, sh.self)
+	log2.Infof("[sharding] reassigned. servers=%d owned=%d gained=%d lost=%d",
+		len(servers), len(a.PartitionsOf(sh.self)), len(gained), len(lost))
+	sh.publish(a)
+	if sh.onAssigned != nil {
+		sh.onAssigned(a)
+	}
+	if sh.onHandoff != nil && (len(gained) > 0 || len(lost) > 0) {
+		sh.onHandoff(Handoff{Gained: gained, Lost: lost, Assignment: a})
+	}
+}
+
+func sameOwners(a, b *Assignment) bool {
+	if len(a.owners) != len(b.owners) {
+		return false
+	}
+	for i := range a.owners {
+		if a.owners[i] != b.owners[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// Assignment returns the current assignment.
+func (sh *Sharding) Assignment() *Assignment {
+	return sh.assignment.Load().(*Assignment)
+}
+
+// Owned returns the partitions owned by the server itself.
+func (sh *Sharding) Owned() []int {
+	return sh.Assignment().PartitionsOf(sh.self)
+}
+
+// Owns reports whether the partition of key is owned by the server itself.
+func (sh *Sharding) Owns(key string) bool {
+	return sh.Assignment().OwnerOf(key) == sh.self
+}
+
+// OnHandoff sets the callback invoked when the server itself gains or loses partitions,
+// the callbacks are invoked one by one in the order of the assignments.
+func (sh *Sharding) OnHandoff(callback func(Handoff)) {
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	sh.onHandoff = callback
+}
+
+// OnAssigned sets the callback invoked when the assignment changes.
+func (sh *Sharding) OnAssigned(callback func(*Assignment)) {
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	sh.onAssigned = callback
+}
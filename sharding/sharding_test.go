@@ -0,0 +1,179 @@
+package sharding
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/cupen/xdisco"
+	"github.com/cupen/xdisco/broker"
+	"github.com/cupen/xdisco/eventhandler"
+	"github.com/cupen/xdisco/health"
+	"github.com/cupen/xdisco/server"
+	"github.com/stretchr/testify/assert"
+)
+
+func newServer(id string) *server.Server {
+	s := server.NewServer(id, "world", "127.0.0.1")
+	s.SetKey("/world/" + id)
+	return s
+}
+
+func newServers(ids ...string) []*server.Server {
+	servers := []*server.Server{}
+	for _, id := range ids {
+		servers = append(servers, newServer(id))
+	}
+	return servers
+}
+
+func TestAssign(t *testing.T) {
+	assert := assert.New(t)
+	a := Assign(1024, newServers("1", "2", "3", "4"))
+	assert.Equal(1024, a.Partitions())
+	total := 0
+	for _, id := range []string{"1", "2", "3", "4"} {
+		n := len(a.PartitionsOf(id))
+		assert.InDelta(256, n, 64, "server %s", id)
+		total += n
+	}
+	assert.Equal(1024, total)
+
+	// only the partitions of the server gone are moved
+	b := Assign(1024, newServers("1", "2", "3"))
+	for p := 0; p < 1024; p++ {
+		if a.Owner(p) != "4" {
+			assert.Equal(a.Owner(p), b.Owner(p))
+		}
+	}
+	gained, lost := b.Diff(a, "1")
+	assert.NotEmpty(gained)
+	assert.Empty(lost)
+	gained, lost = b.Diff(a, "4")
+	assert.Empty(gained)
+	assert.Equal(a.PartitionsOf("4"), lost)
+
+	key := "player-1"
+	assert.Equal(a.Owner(a.Partition(key)), a.OwnerOf(key))
+	empty := Assign(8, nil)
+	assert.Equal("", empty.OwnerOf(key))
+}
+
+func TestSharding(t *testing.T) {
+	assert := assert.New(t)
+	sh := New("2", &Options{Partitions: 64})
+	handoffs := []Handoff{}
+	sh.OnHandoff(func(h Handoff) { handoffs = append(handoffs, h) })
+	assigned := 0
+	sh.OnAssigned(func(*Assignment) { assigned++ })
+	assert.Empty(sh.Owned())
+
+	sh.Update(newServers("1", "2"))
+	if assert.Len(handoffs, 1) {
+		assert.Equal(sh.Owned(), handoffs[0].Gained)
+		assert.Empty(handoffs[0].Lost)
+	}
+
+	// the same servers in another order
+	sh.Update(newServers("2", "1"))
+	assert.Equal(1, assigned)
+
+	// a server joins, this one loses some partitions only
+	owned := sh.Owned()
+	sh.Update(newServers("1", "2", "3"))
+	assert.Equal(2, assigned)
+	if assert.Len(handoffs, 2) {
+		assert.Empty(handoffs[1].Gained)
+		assert.Subset(owned, handoffs[1].Lost)
+	}
+	for i := 0; i < 100; i++ {
+		key := fmt.Sprintf("player-%d", i)
+		assert.Equal(sh.Assignment().OwnerOf(key) == "2", sh.Owns(key))
+	}
+
+	// drained, loses all
+	sh.Update(newServers("1", "3"))
+	assert.Empty(sh.Owned())
+	assert.Len(handoffs, 3)
+}
+
+// fakeBroker emits the events of the servers set by the test.
+type fakeBroker struct {
+	broker.Broker
+	servers []*server.Server
+	h       eventhandler.Handler
+}
+
+func (b *fakeBroker) Watch(ctx context.Context, kind string, h eventhandler.Handler, hc server.Checker) error {
+	b.h = h
+	h.OnInit(b.servers)
+	return nil
+}
+
+func TestSharding_Attach(t *testing.T) {
+	assert := assert.New(t)
+	bk := &fakeBroker{servers: newServers("1", "2")}
+	svc := xdisco.NewService("world", bk, health.Custom(func(*server.Server) error { return nil }))
+	a, b := New("1", &Options{Partitions: 64}), New("2", &Options{Partitions: 64})
+	a.Attach(svc)
+	detach := b.Attach(svc)
+	assert.NoError(svc.Start(context.TODO()))
+	assert.Equal(64, len(a.Owned())+len(b.Owned()))
+
+	// both follow the service until detached
+	bk.h.OnAdd("/world/3", newServer("3"))
+	assert.Equal(3, len(a.Assignment().owned))
+	assert.Equal(3, len(b.Assignment().owned))
+	detach()
+	bk.h.OnDelete("/world/3")
+	assert.Equal(2, len(a.Assignment().owned))
+	assert.Equal(3, len(b.Assignment().owned))
+}
+
+type fakeRegistration struct {
+	*broker.Record
+}
+
+func (r fakeRegistration) Deregister(context.Context) error {
+	r.Close()
+	return nil
+}
+
+func TestSharding_Publish(t *testing.T) {
+	assert := assert.New(t)
+	sh := New("2", &Options{Partitions: 64})
+	self := newServer("2")
+	reg := fakeRegistration{broker.NewRecord(self)}
+	sh.Publish(reg)
+	published, ok := Published(reg.Server())
+	assert.True(ok)
+	assert.Empty(published)
+
+	// every assignment is published on the server itself
+	sh.Update(newServers("1", "2"))
+	published, ok = Published(reg.Server())
+	assert.True(ok)
+	assert.Equal(sh.Owned(), published)
+	sh.Update(newServers("1", "2", "3"))
+	published, _ = Published(reg.Server())
+	assert.Equal(sh.Owned(), published)
+
+	_, ok = Published(newServer("1"))
+	assert.False(ok)
+}
+
+func TestFormatPartitions(t *testing.T) {
+	assert := assert.New(t)
+	assert.Equal("", FormatPartitions(nil))
+	assert.Equal("0-3,7,9-10", FormatPartitions([]int{0, 1, 2, 3, 7, 9, 10}))
+	partitions, err := ParsePartitions("0-3,7,9-10")
+	assert.NoError(err)
+	assert.Equal([]int{0, 1, 2, 3, 7, 9, 10}, partitions)
+	partitions, err = ParsePartitions("")
+	assert.NoError(err)
+	assert.Empty(partitions)
+	_, err = ParsePartitions("3-1")
+	assert.Error(err)
+	_, err = ParsePartitions("a")
+	assert.Error(err)
+}
@@ -0,0 +1,57 @@
+package election_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/cupen/xdisco/election"
+	"github.com/cupen/xdisco/server"
+	"github.com/cupen/xdisco/tests/etcdtest"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEtcd(t *testing.T) {
+	assert := assert.New(t)
+	bk := etcdtest.NewBroker(t, etcdtest.Options(t, "/xdisco-test"))
+	opts := &election.Options{TTL: 2 * time.Second}
+	a, b := election.NewEtcd(bk, opts), election.NewEtcd(bk, opts)
+	leaders := make(chan *server.Server, 10)
+	b.OnLeaderChanged(func(s *server.Server) { leaders <- s })
+
+	ctx := context.TODO()
+	assert.NoError(a.Campaign(ctx, "scheduler", server.NewServer("a", "scheduler", "10.0.0.1")))
+	assert.Equal("a", a.Leader().ID)
+	assert.ErrorIs(a.Campaign(ctx, "scheduler", server.NewServer("a", "scheduler", "10.0.0.1")), election.ErrCampaigning)
+
+	// a follower observes the leader while campaigning
+	elected := make(chan error, 1)
+	go func() {
+		elected <- b.Campaign(ctx, "scheduler", server.NewServer("b", "scheduler", "10.0.0.2"))
+	}()
+	select {
+	case s := <-leaders:
+		assert.Equal("10.0.0.1", s.Host)
+	case <-time.After(3 * time.Second):
+		t.Fatal("leader not observed")
+	}
+
+	// takes over once the leader resigns
+	assert.NoError(a.Resign(ctx))
+	assert.Nil(a.Leader())
+	select {
+	case err := <-elected:
+		assert.NoError(err)
+	case <-time.After(3 * time.Second):
+		t.Fatal("not elected after the leader resigned")
+	}
+	assert.Equal("b", b.Leader().ID)
+
+	// campaign given up with ctx
+	timeout, cancel := context.WithTimeout(ctx, 100*time.Millisecond)
+	defer cancel()
+	assert.Error(a.Campaign(timeout, "scheduler", server.NewServer("a", "scheduler", "10.0.0.1")))
+	assert.NoError(b.Resign(ctx))
+	assert.NoError(a.Campaign(ctx, "scheduler", server.NewServer("a", "scheduler", "10.0.0.1")))
+	assert.NoError(a.Resign(ctx))
+}
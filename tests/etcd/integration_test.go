@@ -0,0 +1,478 @@
+package etcd_test
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cupen/xdisco/broker"
+	"github.com/cupen/xdisco/broker/etcd"
+	"github.com/cupen/xdisco/eventhandler"
+	"github.com/cupen/xdisco/health"
+	"github.com/cupen/xdisco/server"
+	"github.com/cupen/xdisco/tests/etcdtest"
+	"github.com/stretchr/testify/assert"
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+// recorder records the events received by a watch.
+type recorder struct {
+	mu      sync.Mutex
+	events  []string
+	servers map[string]*server.Server
+}
+
+func newRecorder() *recorder {
+	return &recorder{servers: map[string]*server.Server{}}
+}
+
+func (r *recorder) handler() eventhandler.Handler {
+	return eventhandler.Handler{
+		OnInit: func(servers []*server.Server) {
+			r.mu.Lock()
+			defer r.mu.Unlock()
+			for _, s := range servers {
+				r.servers[s.GetKey()] = s
+				r.events = append(r.events, "init:"+s.ID)
+			}
+		},
+		OnAdd: func(key string, s *server.Server) {
+			r.mu.Lock()
+			defer r.mu.Unlock()
+			r.servers[key] = s
+			r.events = append(r.events, "add:"+s.ID)
+		},
+		OnUpdate: func(key string, s *server.Server) {
+			r.mu.Lock()
+			defer r.mu.Unlock()
+			r.servers[key] = s
+			r.events = append(r.events, fmt.Sprintf("update:%s:%s", s.ID, s.Status))
+		},
+		OnDelete: func(key string) {
+			r.mu.Lock()
+			defer r.mu.Unlock()
+			delete(r.servers, key)
+			r.events = append(r.events, "delete:"+key)
+		},
+	}
+}
+
+func (r *recorder) get(key string) *server.Server {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.servers[key]
+}
+
+func (r *recorder) has(event string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, ev := range r.events {
+		if ev == event {
+			return true
+		}
+	}
+	return false
+}
+
+func startWatch(t *testing.T, bk *etcd.Etcd, kind string) *recorder {
+	rec := newRecorder()
+	ctx, cancel := context.WithCancel(context.TODO())
+	t.Cleanup(cancel)
+	hc := health.Custom(func(*server.Server) error { return nil })
+	if err := bk.Watch(ctx, kind, rec.handler(), hc); err != nil {
+		t.Fatal(err)
+	}
+	return rec
+}
+
+const waitFor = 5 * time.Second
+
+func TestIntegration(_t *testing.T) {
+	opts := etcdtest.Options(_t, "/testcase/integration")
+	opts.UpdateInterval = 10 * time.Millisecond
+	bk := etcdtest.NewBroker(_t, opts)
+
+	_t.Run("start", func(t *testing.T) {
+		assert := assert.New(t)
+		ctx, cancel := context.WithCancel(context.TODO())
+		defer cancel()
+		s := newServer(1)
+		reg, err := bk.Start(ctx, s)
+		assert.NoError(err)
+		defer reg.Deregister(context.TODO())
+
+		resp, err := bk.Client().Get(context.TODO(), etcdtest.Key(bk, s.Kind, s.ID))
+		assert.NoError(err)
+		if assert.Len(resp.Kvs, 1) {
+			kv := resp.Kvs[0]
+			registered, err := server.NewServerFromEtcd(string(kv.Key), kv.Value)
+			assert.NoError(err)
+			assert.Equal(server.States.Running, registered.GetStatus())
+
+			// the record is bound to a lease being kept alive
+			assert.NotZero(kv.Lease)
+			ttl, err := bk.Client().TimeToLive(context.TODO(), clientv3.LeaseID(kv.Lease))
+			assert.NoError(err)
+			assert.Greater(ttl.TTL, int64(0))
+		}
+	})
+
+	_t.Run("setState", func(t *testing.T) {
+		assert := assert.New(t)
+		kind := "setstate"
+		rec := startWatch(t, bk, kind)
+		s := server.NewServer("1", kind, "127.0.0.1")
+		reg, err := bk.Start(context.TODO(), s)
+		assert.NoError(err)
+		defer reg.Deregister(context.TODO())
+		key := etcdtest.Key(bk, kind, s.ID)
+		assert.Eventually(func() bool { return rec.get(key) != nil }, waitFor, 10*time.Millisecond)
+
+		reg.SetState(server.States.Stopping)
+		assert.Eventually(func() bool { return rec.has("update:1:stopping") }, waitFor, 10*time.Millisecond)
+
+		bk.SetState(server.States.Running)
+		assert.Eventually(func() bool { return rec.has("update:1:running") }, waitFor, 10*time.Millisecond)
+
+		reg.SetAnnotation("map", "v2")
+		reg.SetHealth(false, "warming up")
+		assert.Eventually(func() bool {
+			s := rec.get(key)
+			v, _ := s.GetAnnotation("map")
+			return v == "v2" && !s.IsReady()
+		}, waitFor, 10*time.Millisecond)
+	})
+
+	_t.Run("deregister", func(t *testing.T) {
+		assert := assert.New(t)
+		kind := "deregister"
+		rec := startWatch(t, bk, kind)
+		s := server.NewServer("1", kind, "127.0.0.1")
+		reg, err := bk.Start(context.TODO(), s)
+		assert.NoError(err)
+		key := etcdtest.Key(bk, kind, s.ID)
+		assert.Eventually(func() bool { return rec.has("add:1") }, waitFor, 10*time.Millisecond)
+
+		assert.NoError(reg.Deregister(context.TODO()))
+		select {
+		case <-reg.Done():
+		default:
+			assert.Fail("registration not done")
+		}
+		resp, err := bk.Client().Get(context.TODO(), key)
+		assert.NoError(err)
+		assert.Empty(resp.Kvs)
+		assert.Eventually(func() bool { return rec.has("delete:" + key) }, waitFor, 10*time.Millisecond)
+	})
+
+	_t.Run("stopNotRegistered", func(t *testing.T) {
+		assert := assert.New(t)
+		kind := "stopforeign"
+		s := server.NewServer("1", kind, "127.0.0.1")
+		data, err := json.Marshal(s)
+		assert.NoError(err)
+		key := etcdtest.Key(bk, kind, s.ID)
+		_, err = bk.Client().Put(context.TODO(), key, string(data))
+		assert.NoError(err)
+
+		err = bk.Stop(context.TODO(), s)
+		assert.ErrorIs(err, etcd.ErrNotRegistered)
+		resp, err := bk.Client().Get(context.TODO(), key)
+		assert.NoError(err)
+		assert.Len(resp.Kvs, 1)
+	})
+
+	_t.Run("contextCancelled", func(t *testing.T) {
+		assert := assert.New(t)
+		kind := "cancelled"
+		rec := startWatch(t, bk, kind)
+		ctx, cancel := context.WithCancel(context.TODO())
+		s := server.NewServer("1", kind, "127.0.0.1")
+		reg, err := bk.Start(ctx, s)
+		assert.NoError(err)
+		key := etcdtest.Key(bk, kind, s.ID)
+		assert.Eventually(func() bool { return rec.has("add:1") }, waitFor, 10*time.Millisecond)
+
+		cancel()
+		<-reg.Done()
+		assert.Eventually(func() bool { return rec.has("delete:" + key) }, waitFor, 10*time.Millisecond)
+	})
+
+	_t.Run("leaseExpired", func(t *testing.T) {
+		assert := assert.New(t)
+		kind := "expired"
+		rec := startWatch(t, bk, kind)
+		s := server.NewServer("1", kind, "127.0.0.1")
+		reg, err := bk.Start(context.TODO(), s)
+		assert.NoError(err)
+		defer reg.Deregister(context.TODO())
+		key := etcdtest.Key(bk, kind, s.ID)
+		assert.Eventually(func() bool { return rec.has("add:1") }, waitFor, 10*time.Millisecond)
+
+		lost := make(chan *server.Server, 1)
+		reregistered := make(chan *server.Server, 1)
+		bk.OnLeaseLost(func(s *server.Server) { lost <- s })
+		bk.OnReregistered(func(s *server.Server) { reregistered <- s })
+		defer bk.OnLeaseLost(nil)
+		defer bk.OnReregistered(nil)
+
+		resp, err := bk.Client().Get(context.TODO(), key)
+		assert.NoError(err)
+		oldLease := resp.Kvs[0].Lease
+		_, err = bk.Client().Revoke(context.TODO(), clientv3.LeaseID(oldLease))
+		assert.NoError(err)
+		assert.Eventually(func() bool { return rec.has("delete:" + key) }, waitFor, 10*time.Millisecond)
+
+		// registered again under a new lease
+		select {
+		case s := <-lost:
+			assert.Equal("1", s.ID)
+		case <-time.After(waitFor):
+			assert.FailNow("lease lost not notified")
+		}
+		select {
+		case s := <-reregistered:
+			assert.Equal("1", s.ID)
+		case <-time.After(waitFor):
+			assert.FailNow("re-registration not notified")
+		}
+		assert.Eventually(func() bool { return rec.get(key) != nil }, waitFor, 10*time.Millisecond)
+		resp, err = bk.Client().Get(context.TODO(), key)
+		assert.NoError(err)
+		if assert.Len(resp.Kvs, 1) {
+			assert.NotEqual(oldLease, resp.Kvs[0].Lease)
+		}
+	})
+
+	_t.Run("recordLost", func(t *testing.T) {
+		assert := assert.New(t)
+		kind := "recordlost"
+		s := server.NewServer("1", kind, "127.0.0.1")
+		reg, err := bk.Start(context.TODO(), s)
+		assert.NoError(err)
+		defer reg.Deregister(context.TODO())
+		key := etcdtest.Key(bk, kind, s.ID)
+		resp, err := bk.Client().Get(context.TODO(), key)
+		assert.NoError(err)
+		oldLease := clientv3.LeaseID(resp.Kvs[0].Lease)
+
+		// the record is deleted while its lease is alive, the next write finds it lost
+		_, err = bk.Client().Delete(context.TODO(), key)
+		assert.NoError(err)
+		reg.SetAnnotation("map", "v2")
+		assert.Eventually(func() bool {
+			resp, err := bk.Client().Get(context.TODO(), key)
+			return err == nil && len(resp.Kvs) == 1 && clientv3.LeaseID(resp.Kvs[0].Lease) != oldLease
+		}, waitFor, 10*time.Millisecond)
+
+		// the old lease is revoked rather than kept alive
+		ttl, err := bk.Client().TimeToLive(context.TODO(), oldLease)
+		assert.NoError(err)
+		assert.Equal(int64(-1), ttl.TTL)
+	})
+
+	_t.Run("duplicated", func(t *testing.T) {
+		assert := assert.New(t)
+		kind := "duplicated"
+		s := server.NewServer("1", kind, "127.0.0.1")
+		reg, err := bk.Start(context.TODO(), s)
+		assert.NoError(err)
+		defer reg.Deregister(context.TODO())
+
+		// another process started with the same ID
+		other, err := etcd.New(opts)
+		assert.NoError(err)
+		defer other.Client().Close()
+		_, err = other.Start(context.TODO(), server.NewServer("1", kind, "127.0.0.2"))
+		assert.ErrorIs(err, etcd.ErrDuplicated)
+
+		resp, err := bk.Client().Get(context.TODO(), etcdtest.Key(bk, kind, s.ID))
+		assert.NoError(err)
+		if assert.Len(resp.Kvs, 1) {
+			registered, err := server.NewServerFromEtcd(string(resp.Kvs[0].Key), resp.Kvs[0].Value)
+			assert.NoError(err)
+			assert.Equal("127.0.0.1", registered.Host)
+		}
+	})
+
+	_t.Run("foreignWrite", func(t *testing.T) {
+		assert := assert.New(t)
+		kind := "foreign"
+		s := server.NewServer("1", kind, "127.0.0.1")
+		reg, err := bk.Start(context.TODO(), s)
+		assert.NoError(err)
+		defer reg.Deregister(context.TODO())
+		key := etcdtest.Key(bk, kind, s.ID)
+
+		// the key is taken over by someone else
+		foreign := server.NewServer("1", kind, "127.0.0.2")
+		data, _ := json.Marshal(foreign)
+		_, err = bk.Client().Put(context.TODO(), key, string(data))
+		assert.NoError(err)
+
+		// the coalesced update is refused rather than overwriting the foreign record
+		reg.SetAnnotation("map", "v2")
+		assert.Never(func() bool {
+			resp, err := bk.Client().Get(context.TODO(), key)
+			if err != nil || len(resp.Kvs) != 1 {
+				return true
+			}
+			registered, err := server.NewServerFromEtcd(key, resp.Kvs[0].Value)
+			return err != nil || registered.Host != "127.0.0.2"
+		}, 20*opts.UpdateInterval, opts.UpdateInterval)
+		resp, err := bk.Client().Get(context.TODO(), key)
+		assert.NoError(err)
+		if assert.Len(resp.Kvs, 1) {
+			registered, err := server.NewServerFromEtcd(key, resp.Kvs[0].Value)
+			assert.NoError(err)
+			assert.Equal("127.0.0.2", registered.Host)
+			_, ok := registered.GetAnnotation("map")
+			assert.False(ok)
+		}
+	})
+
+	_t.Run("flush", func(t *testing.T) {
+		assert := assert.New(t)
+		kind := "flush"
+		slowOpts := *opts
+		slowOpts.UpdateInterval = time.Minute
+		slow, err := etcd.New(&slowOpts)
+		assert.NoError(err)
+		defer slow.Client().Close()
+
+		s := server.NewServer("1", kind, "127.0.0.1")
+		reg, err := slow.Start(context.TODO(), s)
+		assert.NoError(err)
+		key := etcdtest.Key(slow, kind, s.ID)
+		get := func() *server.Server {
+			resp, err := slow.Client().Get(context.TODO(), key)
+			if err != nil || len(resp.Kvs) != 1 {
+				return nil
+			}
+			s := &server.Server{}
+			if err := json.Unmarshal(resp.Kvs[0].Value, s); err != nil {
+				return nil
+			}
+			return s
+		}
+		// the first change goes out right away, the next ones wait for the update interval.
+		reg.SetWeight(2)
+		assert.Eventually(func() bool {
+			s := get()
+			return s != nil && s.Weight == 2
+		}, waitFor, 10*time.Millisecond)
+		reg.SetState(server.States.Stopping)
+		assert.NoError(reg.Flush(context.TODO()))
+		if s := get(); assert.NotNil(s) {
+			assert.Equal("stopping", s.Status)
+		}
+
+		assert.NoError(reg.Deregister(context.TODO()))
+		assert.ErrorIs(reg.Flush(context.TODO()), broker.ErrDeregistered)
+	})
+
+	_t.Run("keepaliveOnly", func(t *testing.T) {
+		assert := assert.New(t)
+		kind := "keepalive"
+		fastOpts := *opts
+		fastOpts.TTL = time.Second
+		fastOpts.HeartbeatInterval = 700 * time.Millisecond
+		fast, err := etcd.New(&fastOpts)
+		assert.NoError(err)
+		defer fast.Client().Close()
+
+		rec := startWatch(t, fast, kind)
+		s := server.NewServer("1", kind, "127.0.0.1")
+		s.SetAnnotation("map", "v1")
+		reg, err := fast.Start(context.TODO(), s, func(s *server.Server) {
+			s.SetAnnotation("map", "v1")
+		})
+		assert.NoError(err)
+		defer reg.Deregister(context.TODO())
+		key := etcdtest.Key(fast, kind, s.ID)
+		assert.Eventually(func() bool { return rec.get(key) != nil }, waitFor, 10*time.Millisecond)
+		resp, err := fast.Client().Get(context.TODO(), key)
+		assert.NoError(err)
+		rev := resp.Kvs[0].ModRevision
+
+		// several keepalives pass before the heartbeat, the hook leaves the server unchanged
+		assert.Never(func() bool {
+			resp, err := fast.Client().Get(context.TODO(), key)
+			return err != nil || len(resp.Kvs) != 1 || resp.Kvs[0].ModRevision != rev
+		}, 500*time.Millisecond, 10*time.Millisecond)
+
+		// the heartbeat rewrites the unchanged server with a fresh updatedAt, the watchers see no update
+		assert.Eventually(func() bool {
+			resp, err := fast.Client().Get(context.TODO(), key)
+			return err == nil && len(resp.Kvs) == 1 && resp.Kvs[0].ModRevision != rev
+		}, waitFor, 10*time.Millisecond)
+		assert.Never(func() bool {
+			rec.mu.Lock()
+			defer rec.mu.Unlock()
+			return len(rec.events) != 1
+		}, 300*time.Millisecond, 10*time.Millisecond)
+	})
+
+	_t.Run("keepaliveOutlivesTTL", func(t *testing.T) {
+		assert := assert.New(t)
+		kind := "outlive"
+		shortOpts := *opts
+		shortOpts.TTL = time.Second
+		shortOpts.HeartbeatInterval = -1
+		short := etcdtest.NewBroker(t, &shortOpts)
+
+		s := server.NewServer("1", kind, "127.0.0.1")
+		reg, err := short.Start(context.TODO(), s)
+		assert.NoError(err)
+		defer reg.Deregister(context.TODO())
+		key := etcdtest.Key(short, kind, s.ID)
+		resp, err := short.Client().Get(context.TODO(), key)
+		assert.NoError(err)
+		if !assert.Len(resp.Kvs, 1) {
+			return
+		}
+		lease, rev := resp.Kvs[0].Lease, resp.Kvs[0].ModRevision
+		ttl, err := short.Client().TimeToLive(context.TODO(), clientv3.LeaseID(lease))
+		assert.NoError(err)
+		granted := time.Duration(ttl.GrantedTTL) * time.Second
+
+		// the record is never rewritten, only the keepalive holds it past the lease TTL
+		assert.Never(func() bool {
+			resp, err := short.Client().Get(context.TODO(), key)
+			return err != nil || len(resp.Kvs) != 1
+		}, 2*granted, 100*time.Millisecond)
+		resp, err = short.Client().Get(context.TODO(), key)
+		assert.NoError(err)
+		if assert.Len(resp.Kvs, 1) {
+			assert.Equal(lease, resp.Kvs[0].Lease)
+			assert.Equal(rev, resp.Kvs[0].ModRevision)
+		}
+	})
+
+	_t.Run("eventSequence", func(t *testing.T) {
+		assert := assert.New(t)
+		kind := "sequence"
+		existing := server.NewServer("0", kind, "127.0.0.1")
+		reg0, err := bk.Start(context.TODO(), existing)
+		assert.NoError(err)
+		defer reg0.Deregister(context.TODO())
+
+		rec := startWatch(t, bk, kind)
+		s := server.NewServer("1", kind, "127.0.0.1")
+		reg, err := bk.Start(context.TODO(), s)
+		assert.NoError(err)
+		assert.Eventually(func() bool { return rec.has("add:1") }, waitFor, 10*time.Millisecond)
+		reg.SetState(server.States.Stopping)
+		assert.Eventually(func() bool { return rec.has("update:1:stopping") }, waitFor, 10*time.Millisecond)
+		assert.NoError(reg.Deregister(context.TODO()))
+		key := etcdtest.Key(bk, kind, s.ID)
+		assert.Eventually(func() bool { return rec.has("delete:" + key) }, waitFor, 10*time.Millisecond)
+
+		rec.mu.Lock()
+		defer rec.mu.Unlock()
+		assert.Equal([]string{"init:0", "add:1", "update:1:stopping", "delete:" + key}, rec.events)
+	})
+}
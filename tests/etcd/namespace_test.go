@@ -0,0 +1,35 @@
+package etcd_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/cupen/xdisco/broker/etcd"
+	"github.com/cupen/xdisco/tests/etcdtest"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNamespace(t *testing.T) {
+	assert := assert.New(t)
+	opts := etcd.DefaultOptions()
+	opts.Endpoints = []string{etcdtest.Start(t)}
+	opts.Namespace = "/tenant1"
+	bk := etcdtest.NewBroker(t, opts)
+
+	reg, err := bk.Start(context.TODO(), newServer(1))
+	assert.NoError(err)
+	defer reg.Deregister(context.TODO())
+
+	key := etcdtest.Key(bk, "usercase01", "1")
+	resp, err := bk.Client().Get(context.TODO(), key)
+	assert.NoError(err)
+	assert.Len(resp.Kvs, 1)
+
+	// the raw key carries the namespace
+	opts2 := etcd.DefaultOptions()
+	opts2.Endpoints = opts.Endpoints
+	bk2 := etcdtest.NewBroker(t, opts2)
+	resp, err = bk2.Client().Get(context.TODO(), "/tenant1"+key)
+	assert.NoError(err)
+	assert.Len(resp.Kvs, 1)
+}
@@ -1,25 +1,27 @@
-package etcd
+package etcd_test
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"sort"
 	"strconv"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/cupen/xdisco/eventhandler"
 	"github.com/cupen/xdisco/health"
 	"github.com/cupen/xdisco/server"
+	"github.com/cupen/xdisco/tests/etcdtest"
 	"github.com/stretchr/testify/assert"
 )
 
 func TestWatch_Init(t *testing.T) {
 	assert := assert.New(t)
 
-	bk, err := New("/testcase/watch/j&jio(llg", 10*time.Second)
-	assert.NoError(err)
-	hchecker := health.Custom(func(addr, publicAddr string) error {
+	bk := etcdtest.NewBroker(t, etcdtest.Options(t, "/testcase/watch/j&jio(llg"))
+	hchecker := health.Custom(func(*server.Server) error {
 		return nil
 	})
 
@@ -29,13 +31,13 @@ func TestWatch_Init(t *testing.T) {
 	servers := make([]*server.Server, serverCount)
 	for i := 0; i < serverCount; i++ {
 		servers[i] = newServer(i + 1)
-		servers[i].SetKey(bk.baseKey + "/" + servers[i].GetKey())
+		servers[i].SetKey(bk.BaseKey() + "/" + servers[i].GetKey())
 		servers[i].Status = "running"
 		bk.Start(ctx, servers[i])
 	}
 	t.Cleanup(func() {
 		for _, s := range servers {
-			bk.stop(s)
+			bk.Stop(context.TODO(), s)
 		}
 	})
 
@@ -71,7 +73,7 @@ func TestWatch_Init(t *testing.T) {
 	}
 
 	assert.True(handler.IsValid())
-	err = bk.Watch(ctx, servers[0].Kind, handler, hchecker)
+	err := bk.Watch(ctx, servers[0].Kind, handler, hchecker)
 	assert.NoError(err)
 	select {
 	case <-ctx.Done():
@@ -99,3 +101,64 @@ func newServer(id int) *server.Server {
 	addr := fmt.Sprintf("127.0.0.1:%d", id)
 	return server.NewServer(strconv.Itoa(id), "usercase01", addr)
 }
+
+func TestWatch_ListThenWatch(t *testing.T) {
+	assert := assert.New(t)
+	bk := etcdtest.NewBroker(t, etcdtest.Options(t, "/testcase/listwatch"))
+	kind := "usercase01"
+	put := func(i int) {
+		s := newServer(i)
+		data, err := json.Marshal(s)
+		assert.NoError(err)
+		_, err = bk.Client().Put(context.TODO(), etcdtest.Key(bk, s.Kind, s.ID), string(data))
+		assert.NoError(err)
+	}
+	for i := 0; i < 50; i++ {
+		put(i)
+	}
+
+	var mu sync.Mutex
+	received := map[string]int{}
+	duplicated := []string{}
+	add := func(key string) {
+		mu.Lock()
+		defer mu.Unlock()
+		if _, ok := received[key]; ok {
+			duplicated = append(duplicated, key)
+		}
+		received[key]++
+	}
+	handler := eventhandler.Handler{
+		OnInit: func(servers []*server.Server) {
+			for _, s := range servers {
+				add(s.GetKey())
+			}
+		},
+		OnAdd:    func(key string, s *server.Server) { add(key) },
+		OnUpdate: func(key string, s *server.Server) {},
+		OnDelete: func(key string) {},
+	}
+
+	// keep writing while the watch is being started.
+	writing := make(chan struct{})
+	go func() {
+		defer close(writing)
+		for i := 50; i < 300; i++ {
+			put(i)
+		}
+	}()
+	ctx, cancel := context.WithCancel(context.TODO())
+	defer cancel()
+	assert.NoError(bk.Watch(ctx, kind, handler, health.Custom(func(*server.Server) error { return nil })))
+	<-writing
+
+	assert.Eventually(func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(received) >= 300
+	}, 5*time.Second, 10*time.Millisecond)
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Equal(300, len(received))
+	assert.Empty(duplicated)
+}
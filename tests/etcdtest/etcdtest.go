@@ -0,0 +1,81 @@
+// Package etcdtest runs in-process etcd servers for the tests against a real cluster.
+// It lives in its own module, so the etcd server is never required by xdisco itself.
+package etcdtest
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cupen/xdisco/broker/etcd"
+	"go.etcd.io/etcd/server/v3/embed"
+)
+
+// freeURL returns an url of a free local port.
+func freeURL(t testing.TB) url.URL {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	return url.URL{Scheme: "http", Host: l.Addr().String()}
+}
+
+// Start boots an in-process etcd server on random ports and returns its client endpoint.
+// The server is closed with the test.
+func Start(t testing.TB) string {
+	t.Helper()
+	cfg := embed.NewConfig()
+	cfg.Name = "xdisco-test"
+	cfg.Dir = t.TempDir()
+	cfg.LogLevel = "error"
+	curl, purl := freeURL(t), freeURL(t)
+	cfg.ListenClientUrls = []url.URL{curl}
+	cfg.AdvertiseClientUrls = []url.URL{curl}
+	cfg.ListenPeerUrls = []url.URL{purl}
+	cfg.AdvertisePeerUrls = []url.URL{purl}
+	cfg.InitialCluster = fmt.Sprintf("%s=%s", cfg.Name, purl.String())
+
+	e, err := embed.StartEtcd(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(e.Close)
+	select {
+	case <-e.Server.ReadyNotify():
+	case <-time.After(10 * time.Second):
+		e.Server.Stop()
+		t.Fatal("embedded etcd took too long to start")
+	}
+	return curl.String()
+}
+
+// Options returns the default broker options under baseKey, pointing to a fresh in-process server.
+func Options(t testing.TB, baseKey string) *etcd.Options {
+	t.Helper()
+	opts := etcd.DefaultOptions()
+	opts.BaseKey = baseKey
+	opts.Endpoints = []string{Start(t)}
+	return opts
+}
+
+// NewBroker returns a broker built with opts, its client is closed with the test.
+func NewBroker(t testing.TB, opts *etcd.Options) *etcd.Etcd {
+	t.Helper()
+	bk, err := etcd.New(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		bk.Client().Close()
+	})
+	return bk
+}
+
+// Key returns the key bk registers the server kind/id under.
+func Key(bk *etcd.Etcd, kind, id string) string {
+	return strings.Join([]string{bk.BaseKey(), kind, id}, "/")
+}